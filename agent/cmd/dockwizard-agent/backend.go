@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/backend"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/backend/api"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/backend/file"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/backend/influxdb"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/backend/multi"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/backend/otlp"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/backend/prometheus"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/backend/statsd"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/backend/stdout"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/config"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/spool"
+	"github.com/sirupsen/logrus"
+)
+
+// newBackend creates the backends in the config
+// Multiple backends are combined into one that sends to all of them
+func newBackend(cfg *config.Config) (backend.Backend, error) {
+	var backends []multi.Named
+	adopted := false
+	for i := range cfg.Backends {
+		c := &cfg.Backends[i]
+
+		var b backend.Backend
+		switch c.Type {
+		case "stdout":
+			b = stdout.New()
+		case "api":
+			b = api.New(c, nil)
+		case "prometheus":
+			p, err := prometheus.New(c.ListenAddress)
+			if err != nil {
+				return nil, fmt.Errorf("failed to start prometheus exporter: %w", err)
+			}
+			b = p
+		case "otlp":
+			b = otlp.New(c, nil)
+		case "influxdb":
+			b = influxdb.New(c, nil)
+		case "statsd":
+			b = statsd.New(c)
+		case "file":
+			f, err := file.New(c)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open metrics file: %w", err)
+			}
+			b = f
+		default:
+			return nil, fmt.Errorf("unknown backend type %q", c.Type)
+		}
+
+		// Every network backend gets its own spool so one backend being
+		// down does not cause the others to receive data twice
+		if cfg.Spool.Directory != "" && spooled(c) {
+			s, err := spool.New(
+				filepath.Join(cfg.Spool.Directory, c.Name),
+				int64(cfg.Spool.MaxSize)*1024*1024,
+				time.Duration(cfg.Spool.MaxAge)*time.Second,
+			)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create spool for backend %s: %w", c.Name, err)
+			}
+
+			// Older versions spooled directly into the directory, hand
+			// those segments to the first spooled backend
+			if !adopted {
+				adopted = true
+				n, err := s.Adopt(cfg.Spool.Directory)
+				if err != nil {
+					return nil, fmt.Errorf("failed to move spooled metrics to backend %s: %w", c.Name, err)
+				}
+				if n > 0 {
+					logrus.Infof("moved %d spooled batches to backend %s", n, c.Name)
+				}
+			}
+			b = s.Wrap(b)
+		}
+
+		backends = append(backends, multi.Named{Name: c.Name, Backend: b})
+	}
+
+	if len(backends) == 1 {
+		return backends[0].Backend, nil
+	}
+	return multi.New(backends, multi.DefaultQueueSize), nil
+}
+
+// spooled returns true if the backend sends over the network and can fail
+// to deliver, local backends have nothing to gain from a spool
+func spooled(c *config.Backend) bool {
+	switch c.Type {
+	case "api", "otlp", "statsd":
+		return true
+	case "influxdb":
+		return !strings.HasPrefix(c.InfluxURL, "file:")
+	default:
+		return false
+	}
+}
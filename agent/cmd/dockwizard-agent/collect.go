@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/agent"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var collect = &cobra.Command{
+	Use:   "collect",
+	Short: "Collect the metrics once and print them without sending them",
+	Run:   collectMn,
+}
+
+func init() {
+	collect.Flags().StringP("output", "o", "table", "Output format, table, json or yaml")
+	collect.Flags().BoolP("all", "a", false, "Also collect containers that are not running")
+	collect.Flags().StringArrayP("filter", "f", nil, "Only collect containers matching the filter, e.g. name=web or label=com.example.tier=frontend")
+}
+
+func collectMn(cmd *cobra.Command, _ []string) {
+	output, _ := cmd.Flags().GetString("output")
+	if output != "table" && output != "json" && output != "yaml" {
+		logrus.Fatalf("output must be table, json or yaml")
+	}
+
+	flt, _ := cmd.Flags().GetStringArray("filter")
+	args := filters.NewArgs()
+	for _, f := range flt {
+		key, value, ok := strings.Cut(f, "=")
+		if !ok || key == "" {
+			logrus.Fatalf("invalid filter %q, must be key=value", f)
+		}
+		args.Add(key, value)
+	}
+
+	if all, _ := cmd.Flags().GetBool("all"); all {
+		cfg.AllContainers = true
+	}
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		logrus.Fatalf("failed to create docker client: %v", err)
+	}
+	defer cli.Close()
+
+	// No backend, the metrics are only printed
+	a, err := agent.New(cfg, nil, cli, agent.WithoutPersistentID())
+	if err != nil {
+		logrus.Fatalf("failed to create agent: %v", err)
+	}
+	if args.Len() > 0 {
+		a.SetFilters(args)
+	}
+
+	metrics, err := a.Collect(context.Background())
+	if err != nil {
+		logrus.Fatalf("failed to collect metrics: %v", err)
+	}
+
+	switch output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(metrics)
+	case "yaml":
+		err = writeYAML(os.Stdout, metrics)
+	default:
+		err = writeTable(os.Stdout, metrics)
+	}
+	if err != nil {
+		logrus.Fatalf("failed to write metrics: %v", err)
+	}
+}
+
+// writeYAML writes the metrics as YAML with the same keys as the JSON output
+// JSON is valid YAML, so the JSON is parsed into a node tree which keeps the
+// key order and re-encoded in block style
+func writeYAML(w io.Writer, metrics *data.Metrics) error {
+	bts, err := json.Marshal(metrics)
+	if err != nil {
+		return err
+	}
+
+	var node yaml.Node
+	err = yaml.Unmarshal(bts, &node)
+	if err != nil {
+		return err
+	}
+	blockStyle(&node)
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	err = enc.Encode(&node)
+	if err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func blockStyle(node *yaml.Node) {
+	node.Style &^= yaml.FlowStyle | yaml.DoubleQuotedStyle
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}
+
+// writeTable writes the host and a line per container, like docker stats
+func writeTable(w io.Writer, metrics *data.Metrics) error {
+	if h := metrics.Host; h != nil {
+		fmt.Fprintf(w, "HOST %s (%s), %s, kernel %s, docker %s\n", h.Hostname, h.AgentID, h.OS, h.Kernel, h.DockerVersion)
+		fmt.Fprintf(w, "CPU %.2f%% of %d, MEM %s / %s (%.2f%%), DISK %s / %s (%.2f%%), LOAD %.2f %.2f %.2f\n",
+			h.CPUUsage, h.CPUs,
+			formatBytes(h.MemoryUsage), formatBytes(h.MemoryTotal), h.MemoryUsagePercentage,
+			formatBytes(h.DiskUsage), formatBytes(h.DiskTotal), h.DiskUsagePercentage,
+			h.Load1, h.Load5, h.Load15)
+		if h.Error != "" {
+			fmt.Fprintf(w, "ERROR %s\n", h.Error)
+		}
+		fmt.Fprintln(w)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(tw, "CONTAINER ID\tNAME\tIMAGE\tSTATE\tCPU %\tMEM USAGE\tMEM %\tNET I/O\tBLOCK I/O\tERROR")
+	for _, c := range metrics.Container {
+		id := c.ID
+		if len(id) > 12 {
+			id = id[:12]
+		}
+		state := c.State
+		if c.ExitCode != nil {
+			state = fmt.Sprintf("%s (%d)", state, *c.ExitCode)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%.2f%%\t%s\t%.2f%%\t%s / %s\t%s / %s\t%s\n",
+			id, c.Name, c.Image, state,
+			c.CPUUsage, formatBytes(c.MemoryUsage), c.MemoryUsagePercentage,
+			formatBytes(c.NetworkIORead), formatBytes(c.NetworkIOWrite),
+			formatBytes(c.BlockIORead), formatBytes(c.BlockIOWrite),
+			c.Error)
+	}
+	return tw.Flush()
+}
+
+// formatBytes formats a size with binary units, e.g. 1.5MiB
+func formatBytes(b int) string {
+	const unit = 1024
+	const units = "KMGTPE"
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+
+	value := float64(b) / unit
+	exp := 0
+	// Switch to the next unit where rounding would print 1024.0
+	for value >= unit-0.05 && exp < len(units)-1 {
+		value /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", value, units[exp])
+}
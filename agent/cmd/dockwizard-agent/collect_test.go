@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestFormatBytes(t *testing.T) {
+	tests := map[int]string{
+		0:                  "0B",
+		1023:               "1023B",
+		1024:               "1.0KiB",
+		1536:               "1.5KiB",
+		1024*1024 - 1:      "1.0MiB",
+		1024 * 1024:        "1.0MiB",
+		5 * 1024 * 1024:    "5.0MiB",
+		3 << 30:            "3.0GiB",
+		1<<40 + 1<<39:      "1.5TiB",
+		1 << 60:            "1.0EiB",
+		1023 * 1024 * 1024: "1023.0MiB",
+	}
+
+	for in, expected := range tests {
+		require.Equal(t, expected, formatBytes(in), "formatBytes(%d)", in)
+	}
+}
+
+func testMetrics() *data.Metrics {
+	exitCode := 1
+	return &data.Metrics{
+		Host: &data.Host{AgentID: "abc", Hostname: "node-1", MemoryTotal: 8 << 30},
+		Container: []*data.ContainerMetrics{
+			{
+				ID:          "0123456789abcdef",
+				Name:        "web",
+				Image:       "nginx",
+				State:       "running",
+				Timestamp:   time.Date(2023, 2, 20, 10, 3, 1, 0, time.UTC),
+				CPUUsage:    1.5,
+				MemoryUsage: 4 << 20,
+				Labels:      map[string]string{"com.acme.team": "checkout"},
+			},
+			{ID: "2", Name: "job", State: "exited", ExitCode: &exitCode},
+		},
+	}
+}
+
+func TestWriteYAML(t *testing.T) {
+	metrics := testMetrics()
+
+	var buf bytes.Buffer
+	require.Nil(t, writeYAML(&buf, metrics))
+
+	// The keys are the JSON keys in the same order
+	var node yaml.Node
+	require.Nil(t, yaml.Unmarshal(buf.Bytes(), &node))
+	container := node.Content[0].Content[3].Content[0]
+	var keys []string
+	for i := 0; i < len(container.Content); i += 2 {
+		keys = append(keys, container.Content[i].Value)
+	}
+
+	jsonBytes, err := json.Marshal(metrics.Container[0])
+	require.Nil(t, err)
+	dec := json.NewDecoder(bytes.NewReader(jsonBytes))
+	var jsonKeys []string
+	_, err = dec.Token()
+	require.Nil(t, err)
+	for dec.More() {
+		key, err := dec.Token()
+		require.Nil(t, err)
+		jsonKeys = append(jsonKeys, key.(string))
+		var value json.RawMessage
+		require.Nil(t, dec.Decode(&value))
+	}
+	require.Equal(t, jsonKeys, keys)
+
+	// Decoding the YAML gives back the same metrics
+	var decoded interface{}
+	require.Nil(t, yaml.Unmarshal(buf.Bytes(), &decoded))
+	roundTrip, err := json.Marshal(decoded)
+	require.Nil(t, err)
+	var got data.Metrics
+	require.Nil(t, json.Unmarshal(roundTrip, &got))
+	require.Equal(t, metrics, &got)
+}
+
+func TestWriteTable(t *testing.T) {
+	var buf bytes.Buffer
+	require.Nil(t, writeTable(&buf, testMetrics()))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.True(t, strings.HasPrefix(lines[0], "HOST node-1 (abc)"))
+	require.Contains(t, lines[1], "MEM 0B / 8.0GiB")
+	require.True(t, strings.HasPrefix(lines[3], "CONTAINER ID"))
+	require.Regexp(t, `^0123456789ab\s+web\s+nginx\s+running\s+1\.50%\s+4\.0MiB`, lines[4])
+	require.Regexp(t, `^2\s+job\s+exited \(1\)`, lines[5])
+}
@@ -25,6 +25,8 @@ func init() {
 	root.PersistentFlags().Bool("overwrite-config", false, "Overwrite the config file if it exists")
 
 	root.AddCommand(run)
+	root.AddCommand(status)
+	root.AddCommand(collect)
 }
 
 func preRun(cmd *cobra.Command, args []string) {
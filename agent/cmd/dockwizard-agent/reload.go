@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/agent"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+// watchInterval is how often the config file is checked for changes
+const watchInterval = 5 * time.Second
+
+// watchConfig reloads the config on SIGHUP and, if watch_config is set,
+// whenever the modification time of the file changes
+func watchConfig(ctx context.Context, path string, a *agent.Agent) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	modTime := fileModTime(path)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logrus.Infof("received SIGHUP, reloading config")
+		case <-ticker.C:
+			if !cfg.WatchConfig {
+				continue
+			}
+			mod := fileModTime(path)
+			if mod.Equal(modTime) {
+				continue
+			}
+			logrus.Infof("config file changed, reloading config")
+		}
+
+		modTime = fileModTime(path)
+		reloadConfig(path, a)
+	}
+}
+
+// reloadConfig reads and validates the config and switches the agent to it
+// The agent keeps running on the current config if anything fails
+func reloadConfig(path string, a *agent.Agent) {
+	c, err := config.Read(path)
+	if err != nil {
+		logrus.Errorf("failed to reload config, keeping the current config: %v", err)
+		return
+	}
+
+	err = a.Reload(c, newBackend)
+	if err != nil {
+		logrus.Errorf("failed to reload config, keeping the current config: %v", err)
+		return
+	}
+
+	cfg = c
+	logrus.Infof("config reloaded")
+}
+
+func fileModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -4,12 +4,10 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/docker/docker/client"
 	"github.com/dockwizard/dockwizard_agent/agent/pkg/agent"
-	"github.com/dockwizard/dockwizard_agent/agent/pkg/backend"
-	"github.com/dockwizard/dockwizard_agent/agent/pkg/backend/api"
-	"github.com/dockwizard/dockwizard_agent/agent/pkg/backend/stdout"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"golang.org/x/net/context"
@@ -21,13 +19,10 @@ var run = &cobra.Command{
 	Run:   runMn,
 }
 
-func runMn(_ *cobra.Command, _ []string) {
-	var b backend.Backend
-	switch cfg.Backend {
-	case "stdout":
-		b = stdout.New()
-	case "api":
-		b = api.New(cfg.APIEndpoint, cfg, nil)
+func runMn(cmd *cobra.Command, _ []string) {
+	b, err := newBackend(cfg)
+	if err != nil {
+		log.Fatalf("failed to create backend: %v", err)
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -38,19 +33,28 @@ func runMn(_ *cobra.Command, _ []string) {
 		log.Fatalf("failed to create docker client: %v", err)
 	}
 
-	agentInstance := agent.New(cfg, b, cli)
+	agentInstance, err := agent.New(cfg, b, cli)
 	if err != nil {
-		logrus.Errorf("failed to create agent: %v", err)
+		cancel()
+		logrus.Fatalf("failed to create agent: %v", err)
 	}
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	// The first SIGINT or SIGTERM stops the agent and lets it flush,
+	// a second one exits immediately
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		for range c {
-			log.Println("gracefully shutting down")
-			cancel()
-		}
+		<-c
+		log.Println("gracefully shutting down")
+		cancel()
+
+		<-c
+		log.Println("forcing shutdown")
+		os.Exit(1)
 	}()
 
+	path, _ := cmd.Flags().GetString("config-file")
+	go watchConfig(ctx, path, agentInstance)
+
 	agentInstance.Run(ctx)
 }
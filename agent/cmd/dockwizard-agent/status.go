@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/docker/docker/client"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/doctor"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var status = &cobra.Command{
+	Use:     "status",
+	Aliases: []string{"doctor"},
+	Short:   "Check the config, the docker daemon and the backends",
+	// The config is checked by the command itself so an invalid one is
+	// reported instead of stopping it
+	PersistentPreRun: func(*cobra.Command, []string) {},
+	Run:              statusMn,
+}
+
+func init() {
+	status.Flags().StringP("output", "o", "text", "Output format, text or json")
+}
+
+func statusMn(cmd *cobra.Command, _ []string) {
+	path, _ := cmd.Flags().GetString("config-file")
+	output, _ := cmd.Flags().GetString("output")
+	if output != "text" && output != "json" {
+		logrus.Fatalf("output must be text or json")
+	}
+
+	report := doctor.Run(context.Background(), path, func() (client.APIClient, error) {
+		return client.NewClientWithOpts(client.FromEnv)
+	})
+
+	var err error
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = report.WriteText(os.Stdout)
+	}
+	if err != nil {
+		logrus.Fatalf("failed to write report: %v", err)
+	}
+
+	if !report.OK {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,187 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+	"github.com/sirupsen/logrus"
+)
+
+// maxPendingEvents is the number of events kept between polls
+// The oldest events are dropped once it is reached
+const maxPendingEvents = 1000
+
+// eventActions are the container lifecycle actions that are reported
+var eventActions = []string{"start", "die", "oom", "kill", "restart", "health_status"}
+
+// reconnectDelay is how long to wait before resubscribing after the
+// event stream failed
+var reconnectDelay = time.Second
+
+// eventWatcher subscribes to the Docker events API and keeps the container
+// lifecycle events until they are sent with the next poll
+type eventWatcher struct {
+	docker client.APIClient
+
+	mu      sync.Mutex
+	pending []*data.ContainerEvent
+	last    time.Time
+	// seen are the events at the last timestamp, several events can share it
+	seen map[eventKey]bool
+}
+
+// eventKey identifies an event, Docker has no event IDs
+type eventKey struct {
+	id     string
+	action string
+	time   int64
+}
+
+func newEventWatcher(cli client.APIClient) *eventWatcher {
+	return &eventWatcher{
+		docker: cli,
+		seen:   map[eventKey]bool{},
+	}
+}
+
+// watch receives events until ctx is canceled, resubscribing if the stream fails
+// Events that happened while the stream was down are requested again
+func (w *eventWatcher) watch(ctx context.Context) {
+	w.mu.Lock()
+	w.last = time.Now()
+	w.mu.Unlock()
+
+	for ctx.Err() == nil {
+		err := w.subscribe(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		logrus.Errorf("docker event stream failed, reconnecting: %v", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+func (w *eventWatcher) subscribe(ctx context.Context) error {
+	args := filters.NewArgs(filters.Arg("type", events.ContainerEventType))
+	for _, action := range eventActions {
+		args.Add("event", action)
+	}
+
+	w.mu.Lock()
+	since := w.last
+	w.mu.Unlock()
+
+	msgs, errs := w.docker.Events(ctx, types.EventsOptions{
+		Since:   fmt.Sprintf("%d.%09d", since.Unix(), since.Nanosecond()),
+		Filters: args,
+	})
+	for {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				return fmt.Errorf("event stream closed")
+			}
+			w.add(msg)
+		case err := <-errs:
+			return err
+		}
+	}
+}
+
+func (w *eventWatcher) add(msg events.Message) {
+	event := parseEvent(msg)
+	if event == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Resubscribing starts at the last event seen, skip anything older and
+	// the events at that time that were already received
+	if event.Timestamp.Before(w.last) {
+		return
+	}
+	key := eventKey{id: event.ID, action: event.Action, time: event.Timestamp.UnixNano()}
+	if event.Timestamp.After(w.last) {
+		w.last = event.Timestamp
+		w.seen = map[eventKey]bool{}
+	} else if w.seen[key] {
+		return
+	}
+	w.seen[key] = true
+
+	if len(w.pending) >= maxPendingEvents {
+		w.pending = w.pending[1:]
+	}
+	w.pending = append(w.pending, event)
+}
+
+// drain returns the events received since the last call
+func (w *eventWatcher) drain() []*data.ContainerEvent {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	ret := w.pending
+	w.pending = nil
+	return ret
+}
+
+// parseEvent turns a Docker event into a container event
+// It returns nil for events that are not reported
+func parseEvent(msg events.Message) *data.ContainerEvent {
+	if msg.Type != events.ContainerEventType {
+		return nil
+	}
+
+	// Health status events carry the status in the action, e.g. "health_status: healthy"
+	action, status, _ := strings.Cut(msg.Action, ": ")
+	found := false
+	for _, a := range eventActions {
+		if a == action {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	timestamp := time.Unix(0, msg.TimeNano)
+	if msg.TimeNano == 0 {
+		timestamp = time.Unix(msg.Time, 0)
+	}
+
+	event := &data.ContainerEvent{
+		ID:           msg.Actor.ID,
+		Name:         msg.Actor.Attributes["name"],
+		Image:        msg.Actor.Attributes["image"],
+		Action:       action,
+		Signal:       msg.Actor.Attributes["signal"],
+		HealthStatus: status,
+		Timestamp:    timestamp.UTC(),
+	}
+
+	if exitCode, ok := msg.Actor.Attributes["exitCode"]; ok {
+		code, err := strconv.Atoi(exitCode)
+		if err == nil {
+			event.ExitCode = &code
+		}
+	}
+
+	return event
+}
@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/dockwizard/dockwizard_agent/agent/internal/testutils"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func newEvent(action string, attributes map[string]string, ts time.Time) events.Message {
+	attributes["name"] = "web"
+	attributes["image"] = "nginx"
+	return events.Message{
+		Type:     events.ContainerEventType,
+		Action:   action,
+		Actor:    events.Actor{ID: "1", Attributes: attributes},
+		Time:     ts.Unix(),
+		TimeNano: ts.UnixNano(),
+	}
+}
+
+func TestParseEvent(t *testing.T) {
+	ts := time.Date(2023, 2, 20, 10, 3, 1, 5, time.UTC)
+
+	event := parseEvent(newEvent("die", map[string]string{"exitCode": "137"}, ts))
+	require.Equal(t, "1", event.ID)
+	require.Equal(t, "web", event.Name)
+	require.Equal(t, "nginx", event.Image)
+	require.Equal(t, "die", event.Action)
+	require.Equal(t, 137, *event.ExitCode)
+	require.Equal(t, ts, event.Timestamp)
+
+	event = parseEvent(newEvent("kill", map[string]string{"signal": "15"}, ts))
+	require.Equal(t, "15", event.Signal)
+	require.Nil(t, event.ExitCode)
+
+	event = parseEvent(newEvent("health_status: unhealthy", map[string]string{}, ts))
+	require.Equal(t, "health_status", event.Action)
+	require.Equal(t, "unhealthy", event.HealthStatus)
+
+	require.Nil(t, parseEvent(newEvent("exec_start: sh", map[string]string{}, ts)))
+
+	msg := newEvent("start", map[string]string{}, ts)
+	msg.Type = events.ImageEventType
+	require.Nil(t, parseEvent(msg))
+}
+
+func TestEventWatcher(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	m := testutils.NewMockAPIClient(ctrl)
+
+	reconnectDelay = time.Millisecond
+	w := newEventWatcher(m)
+
+	start := time.Now()
+	first := make(chan events.Message, 2)
+	firstErrs := make(chan error, 1)
+	first <- newEvent("start", map[string]string{}, start.Add(time.Second))
+	first <- newEvent("oom", map[string]string{}, start.Add(2*time.Second))
+
+	second := make(chan events.Message, 2)
+	secondErrs := make(chan error)
+	// The event at the resubscribe time was already seen
+	second <- newEvent("oom", map[string]string{}, start.Add(2*time.Second))
+	second <- newEvent("die", map[string]string{"exitCode": "1"}, start.Add(3*time.Second))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	gomock.InOrder(
+		m.EXPECT().Events(gomock.Any(), gomock.Any()).Return((<-chan events.Message)(first), (<-chan error)(firstErrs)),
+		m.EXPECT().Events(gomock.Any(), gomock.Any()).Return((<-chan events.Message)(second), (<-chan error)(secondErrs)),
+	)
+
+	done := make(chan struct{})
+	go func() {
+		w.watch(ctx)
+		close(done)
+	}()
+
+	require.Eventually(t, func() bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return len(w.pending) == 2
+	}, time.Second, time.Millisecond)
+	firstErrs <- fmt.Errorf("connection reset")
+
+	require.Eventually(t, func() bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return len(w.pending) == 3
+	}, time.Second, time.Millisecond)
+	cancel()
+	secondErrs <- context.Canceled
+	<-done
+
+	var actions []string
+	for _, e := range w.drain() {
+		actions = append(actions, e.Action)
+	}
+	require.Equal(t, []string{"start", "oom", "die"}, actions)
+	require.Equal(t, 0, len(w.drain()))
+}
+
+func TestEventWatcherSameTime(t *testing.T) {
+	w := newEventWatcher(nil)
+
+	at := time.Now()
+	w.add(newEvent("kill", map[string]string{"signal": "15"}, at))
+	w.add(newEvent("die", map[string]string{"exitCode": "143"}, at))
+	// Received again after resubscribing
+	w.add(newEvent("die", map[string]string{"exitCode": "143"}, at))
+	w.add(newEvent("start", map[string]string{}, at.Add(-time.Second)))
+
+	var actions []string
+	for _, e := range w.drain() {
+		actions = append(actions, e.Action)
+	}
+	require.Equal(t, []string{"kill", "die"}, actions)
+}
@@ -0,0 +1,151 @@
+package agent
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/config"
+)
+
+type filterRule struct {
+	filter config.Filter
+	regex  *regexp.Regexp
+}
+
+// containerFilter decides which containers metrics are collected for
+type containerFilter struct {
+	include []filterRule
+	exclude []filterRule
+}
+
+func newContainerFilter(include, exclude []config.Filter) (*containerFilter, error) {
+	f := &containerFilter{}
+	var err error
+	f.include, err = newFilterRules(include)
+	if err != nil {
+		return nil, err
+	}
+	f.exclude, err = newFilterRules(exclude)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func newFilterRules(list []config.Filter) ([]filterRule, error) {
+	var rules []filterRule
+	for _, f := range list {
+		r := filterRule{filter: f}
+		if f.Regex != "" {
+			re, err := regexp.Compile(f.Regex)
+			if err != nil {
+				return nil, err
+			}
+			r.regex = re
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// matches returns true if the container should be collected
+func (f *containerFilter) matches(container types.Container) bool {
+	name := containerName(container)
+
+	included := len(f.include) == 0
+	for i := range f.include {
+		if f.include[i].matches(name, container) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+
+	for i := range f.exclude {
+		if f.exclude[i].matches(name, container) {
+			return false
+		}
+	}
+	return true
+}
+
+// listFilters returns the docker list filters that select a superset of the
+// containers matched, so docker does not return containers that would be
+// dropped anyway. Only a single include rule can be pushed down since
+// docker combines different filters with AND; excludes never can be
+func (f *containerFilter) listFilters(args filters.Args) filters.Args {
+	if len(f.include) != 1 {
+		return args
+	}
+
+	rule := f.include[0].filter
+	args = args.Clone()
+	for k, v := range rule.Labels {
+		args.Add("label", fmt.Sprintf("%s=%s", k, v))
+	}
+	// A glob without wildcards is an exact name, docker matches the name
+	// filter as a regex against the name with its leading slash
+	// Docker ORs the values of the name filter, so it is left alone if the
+	// args already filter by name; the rule is still applied by matches
+	if rule.Name != "" && !strings.ContainsAny(rule.Name, `*?[\`) && !args.Contains("name") {
+		args.Add("name", fmt.Sprintf("^/%s$", regexp.QuoteMeta(rule.Name)))
+	}
+	return args
+}
+
+func (r *filterRule) matches(name string, container types.Container) bool {
+	if r.filter.Name != "" {
+		ok, err := path.Match(r.filter.Name, name)
+		if err != nil || !ok {
+			return false
+		}
+	}
+	if r.regex != nil && !r.regex.MatchString(name) {
+		return false
+	}
+	if r.filter.Image != "" && !imageMatches(r.filter.Image, container.Image) {
+		return false
+	}
+	for k, v := range r.filter.Labels {
+		if l, ok := container.Labels[k]; !ok || l != v {
+			return false
+		}
+	}
+	return true
+}
+
+// imageMatches matches the image against the glob
+// A glob without a tag or digest also matches the image with any tag
+func imageMatches(glob, image string) bool {
+	if ok, _ := path.Match(glob, image); ok {
+		return true
+	}
+	if hasTag(glob) {
+		return false
+	}
+	ok, _ := path.Match(glob, stripTag(image))
+	return ok
+}
+
+// hasTag returns true if the image reference has a tag or digest
+func hasTag(image string) bool {
+	return strings.Contains(image, "@") || strings.Contains(image[strings.LastIndex(image, "/")+1:], ":")
+}
+
+// stripTag removes the tag and digest from an image reference
+func stripTag(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	slash := strings.LastIndex(image, "/")
+	if i := strings.LastIndex(image, ":"); i > slash {
+		image = image[:i]
+	}
+	return image
+}
@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/dockwizard/dockwizard_agent/agent/internal/testutils"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/config"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContainerFilter(t *testing.T) {
+	f, err := newContainerFilter(
+		[]config.Filter{
+			{Name: "web-*"},
+			{Image: "ghcr.io/acme/*"},
+		},
+		[]config.Filter{
+			{Labels: map[string]string{"dockwizard.ignore": "true"}},
+			{Regex: "-ci-[0-9]+$"},
+		},
+	)
+	require.Nil(t, err)
+
+	for _, test := range []struct {
+		container types.Container
+		expected  bool
+	}{
+		{types.Container{Names: []string{"/web-1"}, Image: "nginx"}, true},
+		{types.Container{Names: []string{"/db"}, Image: "postgres:15"}, false},
+		{types.Container{Names: []string{"/api"}, Image: "ghcr.io/acme/api:1.2"}, true},
+		{types.Container{Names: []string{"/api-ci-42"}, Image: "ghcr.io/acme/api:1.2"}, false},
+		{types.Container{
+			Names:  []string{"/web-2"},
+			Image:  "nginx",
+			Labels: map[string]string{"dockwizard.ignore": "true"},
+		}, false},
+	} {
+		require.Equal(t, test.expected, f.matches(test.container), test.container.Names[0])
+	}
+}
+
+func TestContainerFilterEmpty(t *testing.T) {
+	f, err := newContainerFilter(nil, nil)
+	require.Nil(t, err)
+	require.True(t, f.matches(types.Container{Names: []string{"/web"}}))
+	require.Equal(t, filters.Args{}, f.listFilters(filters.Args{}))
+}
+
+func TestContainerFilterListFilters(t *testing.T) {
+	f, err := newContainerFilter([]config.Filter{
+		{Name: "web", Labels: map[string]string{"tier": "frontend"}},
+	}, nil)
+	require.Nil(t, err)
+	require.Equal(t, filters.NewArgs(
+		filters.Arg("status", "running"),
+		filters.Arg("label", "tier=frontend"),
+		filters.Arg("name", "^/web$"),
+	), f.listFilters(filters.NewArgs(filters.Arg("status", "running"))))
+
+	// Docker ORs name filters, adding the rule's name would widen a name
+	// filter that is already there
+	require.Equal(t, filters.NewArgs(
+		filters.Arg("name", "api"),
+		filters.Arg("label", "tier=frontend"),
+	), f.listFilters(filters.NewArgs(filters.Arg("name", "api"))))
+
+	// Rules are ORed, docker filters ANDed, so several can not be pushed down
+	f, err = newContainerFilter([]config.Filter{{Name: "web"}, {Name: "db"}}, nil)
+	require.Nil(t, err)
+	require.Equal(t, filters.Args{}, f.listFilters(filters.Args{}))
+}
+
+func TestImageMatches(t *testing.T) {
+	require.True(t, imageMatches("nginx", "nginx"))
+	require.True(t, imageMatches("nginx", "nginx:1.25"))
+	require.True(t, imageMatches("nginx", "nginx@sha256:abc"))
+	require.True(t, imageMatches("localhost:5000/app", "localhost:5000/app:1"))
+	require.True(t, imageMatches("nginx:1.*", "nginx:1.25"))
+	require.False(t, imageMatches("nginx:1.*", "nginx:2.0"))
+	require.False(t, imageMatches("nginx", "nginx-exporter:1"))
+}
+
+func TestGetDockerContainerMetricsExcluded(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := testutils.NewMockAPIClient(ctrl)
+	expectInspect(m)
+	agent, err := New(&config.Config{
+		Exclude: []config.Filter{{Labels: map[string]string{"dockwizard.ignore": "true"}}},
+	}, nil, m)
+	require.Nil(t, err)
+
+	m.
+		EXPECT().
+		ContainerList(gomock.Any(), types.ContainerListOptions{}).
+		Return([]types.Container{
+			{ID: "1", Names: []string{"/web"}, State: "running"},
+			{ID: "2", Names: []string{"/sidecar"}, State: "running", Labels: map[string]string{"dockwizard.ignore": "true"}},
+		}, nil)
+	m.
+		EXPECT().
+		ContainerStatsOneShot(gomock.Any(), "1").
+		Return(newContainerStats(), nil)
+
+	metrics, err := agent.getDockerContainerMetrics(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 1, len(metrics))
+	require.Equal(t, "web", metrics[0].Name)
+}
+
+func TestGetDockerContainerMetricsIncludeAndNameFilter(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := testutils.NewMockAPIClient(ctrl)
+	agent, err := New(&config.Config{
+		Include: []config.Filter{{Name: "web"}},
+	}, nil, m)
+	require.Nil(t, err)
+	agent.SetFilters(filters.NewArgs(filters.Arg("name", "api")))
+
+	// Only the CLI name filter is passed to docker, the include rule is
+	// applied on top of it so the result is narrowed and not widened
+	m.
+		EXPECT().
+		ContainerList(gomock.Any(), types.ContainerListOptions{Filters: filters.NewArgs(filters.Arg("name", "api"))}).
+		Return([]types.Container{
+			{ID: "1", Names: []string{"/api"}, State: "running"},
+		}, nil)
+
+	metrics, err := agent.getDockerContainerMetrics(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 0, len(metrics))
+}
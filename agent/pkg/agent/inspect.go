@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// inspectTTL is how long the inspect result of a container is reused
+var inspectTTL = 5 * time.Minute
+
+type inspectEntry struct {
+	// state is the state the container was in when it was inspected
+	state   string
+	inspect types.ContainerJSON
+	expires time.Time
+}
+
+// inspectCache caches container and image inspect results
+// Only running containers are cached. They are inspected again once their
+// state changes, after inspectTTL or when they are forgotten because they
+// restarted between two polls. Containers that are not running are
+// always inspected, their exit code and finish time change with every
+// restart without the state changing
+type inspectCache struct {
+	docker client.APIClient
+	now    func() time.Time
+
+	mu         sync.Mutex
+	containers map[string]*inspectEntry
+	// digests are the repository digests by image ID
+	digests map[string]string
+}
+
+func newInspectCache(cli client.APIClient) *inspectCache {
+	return &inspectCache{
+		docker:     cli,
+		now:        time.Now,
+		containers: map[string]*inspectEntry{},
+		digests:    map[string]string{},
+	}
+}
+
+// container returns the inspect result of the container in the given state
+func (c *inspectCache) container(ctx context.Context, id, state string) (types.ContainerJSON, error) {
+	c.mu.Lock()
+	entry, ok := c.containers[id]
+	c.mu.Unlock()
+	if ok && state == "running" && entry.state == state && c.now().Before(entry.expires) {
+		return entry.inspect, nil
+	}
+
+	inspect, err := c.docker.ContainerInspect(ctx, id)
+	if err != nil {
+		return types.ContainerJSON{}, err
+	}
+
+	c.mu.Lock()
+	c.containers[id] = &inspectEntry{
+		state:   state,
+		inspect: inspect,
+		expires: c.now().Add(inspectTTL),
+	}
+	c.mu.Unlock()
+	return inspect, nil
+}
+
+// forget drops the inspect result of the container so it is inspected again
+func (c *inspectCache) forget(id string) {
+	c.mu.Lock()
+	delete(c.containers, id)
+	c.mu.Unlock()
+}
+
+// imageDigest returns the repository digest of the image
+// Images never change, so the digest is kept as long as a container uses it
+func (c *inspectCache) imageDigest(ctx context.Context, imageID string) (string, error) {
+	c.mu.Lock()
+	digest, ok := c.digests[imageID]
+	c.mu.Unlock()
+	if ok {
+		return digest, nil
+	}
+
+	image, _, err := c.docker.ImageInspectWithRaw(ctx, imageID)
+	if err != nil {
+		return "", err
+	}
+	if len(image.RepoDigests) > 0 {
+		_, digest, _ = strings.Cut(image.RepoDigests[0], "@")
+	}
+
+	c.mu.Lock()
+	c.digests[imageID] = digest
+	c.mu.Unlock()
+	return digest, nil
+}
+
+// prune drops the results of containers that no longer exist and of images
+// no container uses
+func (c *inspectCache) prune(containers []types.Container) {
+	ids := map[string]bool{}
+	images := map[string]bool{}
+	for _, container := range containers {
+		ids[container.ID] = true
+		images[container.ImageID] = true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id := range c.containers {
+		if !ids[id] {
+			delete(c.containers, id)
+		}
+	}
+	for id := range c.digests {
+		if !images[id] {
+			delete(c.digests, id)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+	"github.com/sirupsen/logrus"
+)
+
+// Well-known labels set by docker compose and Swarm
+const (
+	composeProjectLabel = "com.docker.compose.project"
+	composeServiceLabel = "com.docker.compose.service"
+	swarmServiceLabel   = "com.docker.swarm.service.name"
+	swarmStackLabel     = "com.docker.stack.namespace"
+)
+
+// addMetadata records the labels and the inspect metadata of the container
+// Inspect results are cached, so a container is not inspected every poll.
+// A failed inspect only fails the container if it is not running, since its
+// state is all there is to report then
+func (a *Agent) addMetadata(ctx context.Context, container types.Container, metrics *data.ContainerMetrics) {
+	metrics.HealthStatus = healthStatus(container.Status)
+	metrics.Labels = a.allowedLabels(container.Labels)
+	metrics.ComposeProject = container.Labels[composeProjectLabel]
+	metrics.ComposeService = container.Labels[composeServiceLabel]
+	metrics.SwarmService = container.Labels[swarmServiceLabel]
+	metrics.SwarmStack = container.Labels[swarmStackLabel]
+	metrics.ImageID = container.ImageID
+	if container.Created != 0 {
+		created := time.Unix(container.Created, 0).UTC()
+		metrics.Created = &created
+	}
+
+	if container.ImageID != "" {
+		digest, err := a.inspect.imageDigest(ctx, container.ImageID)
+		if err != nil {
+			logrus.Warnf("could not inspect image of container %s: %v", metrics.Name, err)
+		}
+		metrics.ImageDigest = digest
+	}
+
+	inspect, err := a.inspect.container(ctx, container.ID, container.State)
+	if err != nil {
+		logrus.Warnf("could not inspect container %s: %v", metrics.Name, err)
+		if !metrics.Running() {
+			metrics.Error = err.Error()
+		}
+		return
+	}
+	if inspect.ContainerJSONBase == nil {
+		return
+	}
+
+	if hc := inspect.HostConfig; hc != nil {
+		metrics.CPULimit = cpuLimit(hc)
+	}
+	if hc := inspect.HostConfig; hc != nil && hc.RestartPolicy.Name != "" {
+		metrics.RestartPolicy = hc.RestartPolicy.Name
+		if hc.RestartPolicy.MaximumRetryCount > 0 {
+			metrics.RestartPolicy = fmt.Sprintf("%s:%d", hc.RestartPolicy.Name, hc.RestartPolicy.MaximumRetryCount)
+		}
+	}
+
+	state := inspect.State
+	if state == nil {
+		return
+	}
+	metrics.StartedAt = parseTime(state.StartedAt)
+
+	// How a container stopped is only interesting while it is stopped
+	// A created container never ran, its zero exit code would read as a
+	// clean exit
+	if !metrics.Running() {
+		metrics.RestartCount = inspect.RestartCount
+	}
+	if metrics.State == "exited" || metrics.State == "dead" {
+		exitCode := state.ExitCode
+		metrics.ExitCode = &exitCode
+		metrics.FinishedAt = parseTime(state.FinishedAt)
+	}
+}
+
+// cpuLimit returns the number of CPUs the container may use, 0 if unlimited
+// --cpus sets NanoCPUs, --cpu-quota and --cpu-period set the CFS quota directly
+func cpuLimit(hc *container.HostConfig) float64 {
+	if hc.NanoCPUs > 0 {
+		return float64(hc.NanoCPUs) / 1e9
+	}
+	if hc.CPUQuota > 0 {
+		period := hc.CPUPeriod
+		if period == 0 {
+			// The kernel's default CFS period is 100ms
+			period = 100000
+		}
+		return float64(hc.CPUQuota) / float64(period)
+	}
+	return 0
+}
+
+// allowedLabels returns the labels matching the configured allow-list
+func (a *Agent) allowedLabels(labels map[string]string) map[string]string {
+	var ret map[string]string
+	for k, v := range labels {
+		for _, glob := range a.Config.ContainerLabels {
+			if ok, _ := path.Match(glob, k); ok {
+				if ret == nil {
+					ret = map[string]string{}
+				}
+				ret[k] = v
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// healthStatus returns the health status from the status docker lists the
+// container with, e.g. "Up 2 hours (healthy)"
+// The listed status is current while an inspect result may be cached
+func healthStatus(status string) string {
+	switch {
+	case strings.HasSuffix(status, "(healthy)"):
+		return "healthy"
+	case strings.HasSuffix(status, "(unhealthy)"):
+		return "unhealthy"
+	case strings.HasSuffix(status, "(health: starting)"):
+		return "starting"
+	}
+	return ""
+}
+
+// parseTime parses a timestamp from docker inspect, which uses the zero
+// time for events that did not happen yet
+func parseTime(s string) *time.Time {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil || t.IsZero() {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,129 @@
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/dockwizard/dockwizard_agent/agent/internal/testutils"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/config"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddMetadata(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := testutils.NewMockAPIClient(ctrl)
+	agent, err := New(&config.Config{
+		ContainerLabels: []string{"com.acme.*"},
+	}, nil, m)
+	require.Nil(t, err)
+
+	c := types.Container{
+		ID:      "1",
+		Names:   []string{"/shop-web-1"},
+		ImageID: "sha256:0123",
+		State:   "running",
+		Status:  "Up 2 hours (healthy)",
+		Created: 1676887381,
+		Labels: map[string]string{
+			"com.acme.team":              "checkout",
+			"com.docker.compose.project": "shop",
+			"com.docker.compose.service": "web",
+			"org.opencontainers.version": "1.2",
+		},
+	}
+
+	m.
+		EXPECT().
+		ImageInspectWithRaw(gomock.Any(), "sha256:0123").
+		Return(types.ImageInspect{RepoDigests: []string{"nginx@sha256:abcd"}}, nil, nil)
+	m.
+		EXPECT().
+		ContainerInspect(gomock.Any(), "1").
+		Return(types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				HostConfig: &container.HostConfig{
+					RestartPolicy: container.RestartPolicy{Name: "on-failure", MaximumRetryCount: 5},
+				},
+				State: &types.ContainerState{
+					Status:    "running",
+					StartedAt: "2023-02-20T10:03:01Z",
+				},
+			},
+		}, nil)
+
+	// The second poll is served from the cache
+	for i := 0; i < 2; i++ {
+		metrics := newContainerMetrics(c)
+		agent.addMetadata(context.Background(), c, metrics)
+
+		require.Equal(t, map[string]string{"com.acme.team": "checkout"}, metrics.Labels)
+		require.Equal(t, "shop", metrics.ComposeProject)
+		require.Equal(t, "web", metrics.ComposeService)
+		require.Equal(t, "healthy", metrics.HealthStatus)
+		require.Equal(t, "sha256:0123", metrics.ImageID)
+		require.Equal(t, "sha256:abcd", metrics.ImageDigest)
+		require.Equal(t, time.Unix(1676887381, 0).UTC(), *metrics.Created)
+		require.Equal(t, time.Date(2023, 2, 20, 10, 3, 1, 0, time.UTC), *metrics.StartedAt)
+		require.Equal(t, "on-failure:5", metrics.RestartPolicy)
+		require.Nil(t, metrics.ExitCode)
+	}
+}
+
+func TestInspectCache(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := testutils.NewMockAPIClient(ctrl)
+	cache := newInspectCache(m)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	m.
+		EXPECT().
+		ContainerInspect(gomock.Any(), "1").
+		Return(types.ContainerJSON{}, nil).
+		Times(6)
+
+	ctx := context.Background()
+	_, err := cache.container(ctx, "1", "running")
+	require.Nil(t, err)
+	_, err = cache.container(ctx, "1", "running")
+	require.Nil(t, err)
+
+	// A state change or an expired entry inspects again
+	_, err = cache.container(ctx, "1", "exited")
+	require.Nil(t, err)
+	_, err = cache.container(ctx, "1", "running")
+	require.Nil(t, err)
+	now = now.Add(inspectTTL)
+	_, err = cache.container(ctx, "1", "running")
+	require.Nil(t, err)
+
+	// A container that is not running may have restarted and stopped again
+	// without its state changing
+	_, err = cache.container(ctx, "1", "exited")
+	require.Nil(t, err)
+	_, err = cache.container(ctx, "1", "exited")
+	require.Nil(t, err)
+
+	cache.prune(nil)
+	require.Equal(t, 0, len(cache.containers))
+}
+
+func TestHealthStatus(t *testing.T) {
+	require.Equal(t, "healthy", healthStatus("Up 2 hours (healthy)"))
+	require.Equal(t, "unhealthy", healthStatus("Up 5 minutes (unhealthy)"))
+	require.Equal(t, "starting", healthStatus("Up 3 seconds (health: starting)"))
+	require.Equal(t, "", healthStatus("Up 2 hours"))
+}
+
+func TestCPULimit(t *testing.T) {
+	require.Equal(t, 1.5, cpuLimit(&container.HostConfig{Resources: container.Resources{NanoCPUs: 1500000000}}))
+	require.Equal(t, 0.5, cpuLimit(&container.HostConfig{Resources: container.Resources{CPUQuota: 50000}}))
+	require.Equal(t, 2.0, cpuLimit(&container.HostConfig{Resources: container.Resources{CPUQuota: 100000, CPUPeriod: 50000}}))
+	require.Equal(t, 0.0, cpuLimit(&container.HostConfig{}))
+}
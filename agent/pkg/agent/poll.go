@@ -2,118 +2,481 @@ package agent
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"log"
 	"math"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
 	"github.com/dockwizard/dockwizard_agent/agent/pkg/backend"
 	"github.com/dockwizard/dockwizard_agent/agent/pkg/config"
 	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
 	"github.com/dockwizard/dockwizard_agent/agent/pkg/dockerstats"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/healthcheck"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/host"
 	"github.com/sirupsen/logrus"
 )
 
+// maxHeldPolls is the number of polls kept while the backend is reloaded
+// The oldest are dropped once it is reached
+const maxHeldPolls = 10
+
 type Agent struct {
 	Config *config.Config
 
-	buffer  []*data.Metrics
+	// mu is held for reading while a poll is in flight and for writing
+	// while the config is changed
+	mu      sync.RWMutex
 	docker  client.APIClient
 	backend backend.Backend
+	health  *healthcheck.Runner
+	rates   *rateTracker
+	inspect *inspectCache
+	agentID string
+	host    *host.Collector
+	filter  *containerFilter
+	// filters are extra filters passed to docker when listing the containers
+	filters filters.Args
+
+	// runCtx is the context Run was started with, used to start the event
+	// watcher if a reload enables it
+	runCtx       context.Context
+	events       *eventWatcher
+	stopEvents   context.CancelFunc
+	eventsBuffer []*data.ContainerEvent
+
+	// reloadMu serializes reloads, which release mu while the old backend
+	// is closed
+	reloadMu sync.Mutex
+	// held are the metrics collected while the backend was being reloaded
+	held []*data.Metrics
+	// persistID is false if the agent ID file must not be written
+	persistID bool
 }
 
-func New(c *config.Config, b backend.Backend, cli client.APIClient) *Agent {
-	return &Agent{
-		Config:  c,
-		buffer:  []*data.Metrics{},
-		docker:  cli,
-		backend: b,
+// Option changes how the agent is set up
+type Option func(a *Agent)
+
+// WithoutPersistentID never writes the agent ID file, for commands that only
+// look at the host. An ID that is already stored is still used
+func WithoutPersistentID() Option {
+	return func(a *Agent) {
+		a.persistID = false
 	}
 }
 
-func (a *Agent) getDockerContainerMetrics() ([]*data.ContainerMetrics, error) {
-	var ret []*data.ContainerMetrics
+func New(c *config.Config, b backend.Backend, cli client.APIClient, opts ...Option) (*Agent, error) {
+	a := &Agent{
+		Config:    c,
+		docker:    cli,
+		backend:   b,
+		rates:     newRateTracker(),
+		inspect:   newInspectCache(cli),
+		persistID: true,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
 
-	ctx := context.TODO()
+	if c.AgentIDFile != "" {
+		// The config directory is often read-only, an ID that can not be
+		// stored must not keep the agent from starting
+		id, err := host.LoadID(c.AgentIDFile, a.persistID)
+		if err != nil {
+			if id == "" {
+				return nil, fmt.Errorf("failed to load agent id: %w", err)
+			}
+			logrus.Warnf("could not store agent id, it changes on restart: %v", err)
+		}
+		a.agentID = id
+	}
+	a.host = host.New(c.HostRoot, a.agentID)
 
-	// Get the metrics
-	allContainers, err := a.docker.ContainerList(ctx, types.ContainerListOptions{})
+	filter, err := newContainerFilter(c.Include, c.Exclude)
 	if err != nil {
 		return nil, err
 	}
+	a.filter = filter
 
-	// Get the metrics for each container
-	for _, container := range allContainers {
-		stats, err := a.docker.ContainerStatsOneShot(ctx, container.ID)
+	if len(c.Containers) > 0 {
+		health, err := healthcheck.New(c.Containers, cli)
 		if err != nil {
 			return nil, err
 		}
+		a.health = health
+	}
 
-		statsBytes, err := io.ReadAll(stats.Body)
-		if err != nil {
-			return nil, err
-		}
-		parsedStats, err := dockerstats.Unmarshal(statsBytes)
-		if err != nil {
-			return nil, err
+	return a, nil
+}
+
+// SetFilters restricts the containers collected to those matching the
+// docker list filters, e.g. name=web or label=com.example.tier=frontend
+func (a *Agent) SetFilters(f filters.Args) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.filters = f
+}
+
+func (a *Agent) getDockerContainerMetrics(ctx context.Context) ([]*data.ContainerMetrics, error) {
+	// Get the metrics
+	listed, err := a.docker.ContainerList(ctx, types.ContainerListOptions{
+		All:     a.Config.AllContainers,
+		Filters: a.filter.listFilters(a.filters),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var allContainers []types.Container
+	for _, container := range listed {
+		if a.filter.matches(container) {
+			allContainers = append(allContainers, container)
 		}
+	}
+
+	// Get the metrics for each container, at most concurrency at a time
+	// Results are stored by index so the order matches the container list
+	ret := make([]*data.ContainerMetrics, len(allContainers))
+	sem := make(chan struct{}, a.concurrency())
+	var wg sync.WaitGroup
+	for i, container := range allContainers {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, container types.Container) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			ret[i] = a.getContainerMetrics(ctx, container)
+		}(i, container)
+	}
+	wg.Wait()
+
+	ids := map[string]bool{}
+	for _, container := range allContainers {
+		ids[container.ID] = true
+	}
+	a.rates.prune(ids)
+	if a.health != nil {
+		a.health.Prune(ids)
+	}
+	a.inspect.prune(allContainers)
+
+	return ret, nil
+}
+
+// getContainerMetrics collects the metrics of a single container
+// If the stats can not be read, e.g. because the container exited after it was
+// listed, the error is recorded on the metrics instead of failing the poll
+// Containers that are not running have no stats, only their metadata and how
+// they stopped are reported
+// Metadata, stats and health checks share one deadline so a container that
+// does not answer is given up on and can not stall the whole poll
+func (a *Agent) getContainerMetrics(ctx context.Context, container types.Container) *data.ContainerMetrics {
+	ctx, cancel := context.WithTimeout(ctx, a.statsTimeout())
+	defer cancel()
+
+	metrics := newContainerMetrics(container)
+	metrics.Timestamp = time.Now().UTC()
+	a.addMetadata(ctx, container, metrics)
+	if !metrics.Running() {
+		return metrics
+	}
 
+	parsedStats, err := a.getContainerStats(ctx, container.ID)
+	if err != nil {
+		logrus.Warnf("could not get stats for container %s: %v", metrics.Name, err)
+		metrics.Error = err.Error()
+	} else {
 		rx, tx := parsedStats.NetworkStats()
+		rxPackets, txPackets := parsedStats.NetworkPackets()
 		read, write := parsedStats.DiskStats()
 
-		ret = append(ret, &data.ContainerMetrics{
-			ID:                    container.ID,
-			Name:                  strings.TrimPrefix(container.Names[0], "/"),
-			Image:                 container.Image,
-			CPUUsage:              math.Round(parsedStats.CpuUsagePercentage()*1000) / 1000,
-			MemoryUsage:           parsedStats.UsedMemory(),
-			MemoryUsagePercentage: math.Round(parsedStats.MemoryUsagePercentage()*1000) / 1000,
-			State:                 container.State,
-			NetworkIORead:         int(rx),
-			NetworkIOWrite:        int(tx),
-			BlockIORead:           int(read),
-			BlockIOWrite:          int(write),
+		// Prefer the daemon's read time so the sample is placed where the
+		// counters were actually read
+		if !parsedStats.Read.IsZero() {
+			metrics.Timestamp = parsedStats.Read
+		}
+		if !parsedStats.PreRead.IsZero() {
+			preRead := parsedStats.PreRead
+			metrics.PreRead = &preRead
+		}
+		metrics.CPUUsage = math.Round(parsedStats.CpuUsagePercentage()*1000) / 1000
+		metrics.CPUUserPercentage = math.Round(parsedStats.CpuUserPercentage()*1000) / 1000
+		metrics.CPUSystemPercentage = math.Round(parsedStats.CpuSystemPercentage()*1000) / 1000
+		for _, usage := range parsedStats.PerCpuPercentages() {
+			metrics.PerCPUUsage = append(metrics.PerCPUUsage, math.Round(usage*1000)/1000)
+		}
+		metrics.CPUPeriods = parsedStats.CPUStats.ThrottlingData.Periods
+		metrics.CPUThrottledPeriods = parsedStats.CPUStats.ThrottlingData.ThrottledPeriods
+		metrics.CPUThrottledTime = parsedStats.CPUStats.ThrottlingData.ThrottledTime
+		metrics.CPUThrottledPercentage = math.Round(parsedStats.ThrottledPercentage()*1000) / 1000
+		metrics.PIDs = parsedStats.PidsStats.Current
+		metrics.PIDsLimit = parsedStats.PidsLimit()
+		metrics.MemoryUsage = parsedStats.UsedMemory()
+		metrics.MemoryUsagePercentage = math.Round(parsedStats.MemoryUsagePercentage()*1000) / 1000
+		metrics.NetworkIORead = int(rx)
+		metrics.NetworkIOWrite = int(tx)
+		metrics.BlockIORead = int(read)
+		metrics.BlockIOWrite = int(write)
+
+		metrics.Rates, metrics.CounterReset = a.rates.update(container.ID, sample{
+			read:      parsedStats.Read,
+			rxBytes:   metrics.NetworkIORead,
+			txBytes:   metrics.NetworkIOWrite,
+			rxPackets: rxPackets,
+			txPackets: txPackets,
+			blkRead:   metrics.BlockIORead,
+			blkWrite:  metrics.BlockIOWrite,
+
+			cpuPeriods:          metrics.CPUPeriods,
+			cpuThrottledPeriods: metrics.CPUThrottledPeriods,
+			cpuThrottledTime:    metrics.CPUThrottledTime,
 		})
+
+		// Counters going backwards mean the container restarted since the
+		// last poll without its state changing, the cached start time is
+		// stale
+		if metrics.CounterReset {
+			a.inspect.forget(container.ID)
+			a.addMetadata(ctx, container, metrics)
+		}
 	}
 
-	return ret, nil
+	// Run the health checks configured for the container
+	if a.health != nil {
+		metrics.HealthChecks = a.health.Run(ctx, container, metrics)
+	}
+
+	return metrics
+}
+
+// getHost collects the host metrics and the version of the Docker engine
+func (a *Agent) getHost(ctx context.Context) *data.Host {
+	metrics := a.host.Collect()
+
+	ctx, cancel := context.WithTimeout(ctx, a.statsTimeout())
+	defer cancel()
+	version, err := a.docker.ServerVersion(ctx)
+	if err != nil {
+		logrus.Warnf("could not get docker version: %v", err)
+		if metrics.Error != "" {
+			metrics.Error += "; "
+		}
+		metrics.Error += err.Error()
+	} else {
+		metrics.DockerVersion = version.Version
+	}
+
+	return metrics
+}
+
+// newContainerMetrics returns the metrics of the container with its identity set
+func newContainerMetrics(container types.Container) *data.ContainerMetrics {
+	return &data.ContainerMetrics{
+		ID:    container.ID,
+		Name:  containerName(container),
+		Image: container.Image,
+		State: container.State,
+	}
+}
+
+// containerName returns the primary name of the container without the leading slash
+func containerName(container types.Container) string {
+	if len(container.Names) == 0 {
+		return container.ID
+	}
+	return strings.TrimPrefix(container.Names[0], "/")
 }
 
-func (a *Agent) sleep() {
-	time.Sleep(time.Duration(a.Config.UpdateFrequency) * time.Second)
+// getContainerStats reads the stats of a single container
+func (a *Agent) getContainerStats(ctx context.Context, id string) (*dockerstats.DockerStats, error) {
+	stats, err := a.docker.ContainerStatsOneShot(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer stats.Body.Close()
+
+	statsBytes, err := io.ReadAll(stats.Body)
+	if err != nil {
+		return nil, err
+	}
+	return dockerstats.Unmarshal(statsBytes)
+}
+
+// concurrency returns the maximum number of containers to collect stats for at once
+func (a *Agent) concurrency() int {
+	if a.Config.Concurrency < 1 {
+		return config.DefaultConcurrency
+	}
+	return a.Config.Concurrency
+}
+
+// statsTimeout returns how long collecting a single container may take
+// It is half the poll interval so a slow container still leaves time to
+// send the rest of the poll before the next one is due
+func (a *Agent) statsTimeout() time.Duration {
+	timeout := time.Duration(a.Config.UpdateFrequency) * time.Second / 2
+	if timeout < time.Second {
+		return time.Second
+	}
+	return timeout
+}
+
+// sleep waits for the poll interval or until ctx is canceled
+func (a *Agent) sleep(ctx context.Context) {
+	a.mu.RLock()
+	interval := time.Duration(a.Config.UpdateFrequency) * time.Second
+	a.mu.RUnlock()
+
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// Collect collects the metrics of the host and the containers once without
+// sending them anywhere
+func (a *Agent) Collect(ctx context.Context) (*data.Metrics, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.collect(ctx)
+}
+
+// collect collects the metrics of the host and the containers, a.mu must be held
+func (a *Agent) collect(ctx context.Context) (*data.Metrics, error) {
+	containerMetrics, err := a.getDockerContainerMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &data.Metrics{
+		Host:      a.getHost(ctx),
+		Container: containerMetrics,
+	}, nil
+}
+
+// poll collects the metrics and sends them to the backend
+// A reload waits for the poll to finish so it is sent with the config it was
+// collected with
+func (a *Agent) poll(ctx context.Context) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	metrics, err := a.collect(ctx)
+	if err != nil {
+		log.Printf("error getting container metrics: %v", err)
+		return
+	}
+
+	// Send the metrics to the backend, or hold them while it is reloaded
+	metrics.Events = a.drainEvents()
+	if a.backend == nil {
+		if len(a.held) >= maxHeldPolls {
+			a.held = a.held[1:]
+		}
+		a.held = append(a.held, metrics)
+		return
+	}
+
+	// Stopping the agent must not abort the send in flight, it gets until
+	// the shutdown timeout to finish
+	sendCtx, cancel := a.detach(ctx)
+	defer cancel()
+	for _, m := range append(a.held, metrics) {
+		err = a.backend.SendData(sendCtx, m)
+		if err != nil {
+			log.Printf("could not send metrics to backend: %v", err)
+		}
+	}
+	a.held = nil
 }
 
+// detach returns a context that is only canceled the shutdown timeout after
+// ctx is done, or when the returned cancel func is called
+func (a *Agent) detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := a.shutdownTimeout()
+	detached, cancel := context.WithCancel(context.Background())
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+			return
+		case <-ctx.Done():
+		}
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-stop:
+		case <-timer.C:
+			cancel()
+		}
+	}()
+
+	return detached, func() {
+		close(stop)
+		cancel()
+	}
+}
+
+// Run polls until ctx is canceled, which also cancels the poll in flight
+// It then gives the backend until the shutdown timeout to send what it has
+// buffered before returning
 func (a *Agent) Run(ctx context.Context) {
+	a.mu.Lock()
+	a.runCtx = ctx
+	if a.Config.Events {
+		a.startEvents()
+	}
+	a.mu.Unlock()
+
 	for {
 		// Sleep for the poll interval
-		a.sleep()
+		a.sleep(ctx)
 
 		// If canceled then break
-		if ctx.Err() == context.Canceled {
+		if ctx.Err() != nil {
 			break
 		}
 
-		containerMetrics, err := a.getDockerContainerMetrics()
-		if err != nil {
-			log.Printf("error getting container metrics: %v", err)
-			continue
-		}
+		a.poll(ctx)
+	}
 
-		// Send the metrics to the backend
-		metrics := &data.Metrics{
-			Container: containerMetrics,
-		}
-		err = a.backend.SendData(metrics)
-		if err != nil {
-			log.Printf("could not send metrics to backend: %v", err)
-		}
+	a.shutdown()
+}
+
+// shutdown flushes the backend and closes the docker client
+func (a *Agent) shutdown() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.shutdownTimeout())
+	defer cancel()
+
+	err := backend.Close(ctx, a.backend)
+	if err != nil {
+		logrus.Errorf("failed to flush backend: %v", err)
 	}
 
-	err := a.docker.Close()
+	err = a.docker.Close()
 	if err != nil {
 		logrus.Errorf("failed to close docker client: %v", err)
 	}
 }
+
+// shutdownTimeout returns how long the backend may take to flush on shutdown
+func (a *Agent) shutdownTimeout() time.Duration {
+	if a.Config.ShutdownTimeout < 1 {
+		return config.DefaultShutdownTimeout * time.Second
+	}
+	return time.Duration(a.Config.ShutdownTimeout) * time.Second
+}
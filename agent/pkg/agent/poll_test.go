@@ -2,11 +2,17 @@ package agent
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
 	"github.com/dockwizard/dockwizard_agent/agent/internal/testutils"
 	"github.com/dockwizard/dockwizard_agent/agent/pkg/backend/stdout"
@@ -15,43 +21,7 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-func newAgent(m client.APIClient) *Agent {
-	return New(&config.Config{}, stdout.New(), m)
-}
-
-func TestGetDockerContainerMetricsEmpty(t *testing.T) {
-	ctrl := gomock.NewController(t)
-
-	m := testutils.NewMockAPIClient(ctrl)
-	agent := newAgent(m)
-
-	m.
-		EXPECT().
-		ContainerList(gomock.Any(), types.ContainerListOptions{}).
-		Return([]types.Container{}, nil)
-
-	metrics, err := agent.getDockerContainerMetrics()
-	require.Nil(t, err)
-	require.Equal(t, 0, len(metrics))
-}
-
-func TestGetDockerContainerMetrics(t *testing.T) {
-	ctrl := gomock.NewController(t)
-
-	m := testutils.NewMockAPIClient(ctrl)
-	agent := newAgent(m)
-
-	containers := []types.Container{
-		{
-			ID: "1",
-			Names: []string{
-				"test",
-			},
-		},
-	}
-
-	var b bytes.Buffer
-	b.Write([]byte(`
+var testStats = `
 	{
 		"read": "2023-02-20T10:03:01.998224131Z",
 		"preread": "0001-01-01T00:00:00Z",
@@ -162,10 +132,60 @@ func TestGetDockerContainerMetrics(t *testing.T) {
 			}
 		}
 	}
-`))
-	containerStats := types.ContainerStats{
+`
+
+func newContainerStats() types.ContainerStats {
+	return types.ContainerStats{
 		OSType: "linux",
-		Body:   io.NopCloser(&b),
+		Body:   io.NopCloser(bytes.NewBufferString(testStats)),
+	}
+}
+
+// expectInspect lets the agent inspect any container, the result is empty
+func expectInspect(m *testutils.MockAPIClient) {
+	m.
+		EXPECT().
+		ContainerInspect(gomock.Any(), gomock.Any()).
+		Return(types.ContainerJSON{}, nil).
+		AnyTimes()
+}
+
+func newAgent(m client.APIClient) *Agent {
+	a, _ := New(&config.Config{}, stdout.New(), m)
+	return a
+}
+
+func TestGetDockerContainerMetricsEmpty(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := testutils.NewMockAPIClient(ctrl)
+	agent := newAgent(m)
+
+	m.
+		EXPECT().
+		ContainerList(gomock.Any(), types.ContainerListOptions{}).
+		Return([]types.Container{}, nil)
+
+	metrics, err := agent.getDockerContainerMetrics(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 0, len(metrics))
+}
+
+func TestGetDockerContainerMetrics(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := testutils.NewMockAPIClient(ctrl)
+	expectInspect(m)
+	agent := newAgent(m)
+
+	containers := []types.Container{
+		{
+			ID: "1",
+			Names: []string{
+				"test",
+			},
+			State: "running",
+		},
 	}
 
 	m.
@@ -176,24 +196,410 @@ func TestGetDockerContainerMetrics(t *testing.T) {
 	m.
 		EXPECT().
 		ContainerStatsOneShot(gomock.Any(), "1").
-		Return(containerStats, nil)
+		Return(newContainerStats(), nil)
 
-	metrics, err := agent.getDockerContainerMetrics()
+	metrics, err := agent.getDockerContainerMetrics(context.Background())
 	require.Nil(t, err)
 	require.Equal(t, 1, len(metrics))
 	require.Equal(t, "1", metrics[0].ID)
 	require.Equal(t, "test", metrics[0].Name)
+	require.Equal(t, 1, metrics[0].PIDs)
+	require.Equal(t, 0, metrics[0].PIDsLimit)
+
+	// The sample is stamped with the time the daemon read the stats
+	require.Equal(t, time.Date(2023, 2, 20, 10, 3, 1, 998224131, time.UTC), metrics[0].Timestamp)
+	require.Nil(t, metrics[0].PreRead)
+}
+
+func TestGetDockerContainerMetricsOrder(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := testutils.NewMockAPIClient(ctrl)
+	expectInspect(m)
+	agent := newAgent(m)
+	agent.Config.Concurrency = 2
+
+	var containers []types.Container
+	for i := 0; i < 5; i++ {
+		id := strconv.Itoa(i)
+		containers = append(containers, types.Container{ID: id, Names: []string{"/" + id}, State: "running"})
+
+		// Later containers answer first
+		delay := time.Duration(5-i) * 5 * time.Millisecond
+		m.
+			EXPECT().
+			ContainerStatsOneShot(gomock.Any(), id).
+			DoAndReturn(func(ctx context.Context, id string) (types.ContainerStats, error) {
+				time.Sleep(delay)
+				return newContainerStats(), nil
+			})
+	}
+
+	m.
+		EXPECT().
+		ContainerList(gomock.Any(), types.ContainerListOptions{}).
+		Return(containers, nil)
+
+	metrics, err := agent.getDockerContainerMetrics(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 5, len(metrics))
+	for i, metric := range metrics {
+		require.Equal(t, strconv.Itoa(i), metric.ID)
+	}
+}
+
+func TestGetDockerContainerMetricsTimeout(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := testutils.NewMockAPIClient(ctrl)
+	expectInspect(m)
+	agent, err := New(&config.Config{UpdateFrequency: 2}, stdout.New(), m)
+	require.Nil(t, err)
+
+	m.
+		EXPECT().
+		ContainerList(gomock.Any(), types.ContainerListOptions{}).
+		Return([]types.Container{{ID: "1", Names: []string{"/hung"}, State: "running"}}, nil)
+
+	m.
+		EXPECT().
+		ContainerStatsOneShot(gomock.Any(), "1").
+		DoAndReturn(func(ctx context.Context, id string) (types.ContainerStats, error) {
+			<-ctx.Done()
+			return types.ContainerStats{}, ctx.Err()
+		})
+
+	start := time.Now()
+	metrics, err := agent.getDockerContainerMetrics(context.Background())
+	require.Nil(t, err)
+	require.True(t, time.Since(start) < 2*time.Second)
+	require.Equal(t, 1, len(metrics))
+	require.Equal(t, "context deadline exceeded", metrics[0].Error)
+}
+
+func TestGetDockerContainerMetricsTimeoutHealthCheck(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := testutils.NewMockAPIClient(ctrl)
+	expectInspect(m)
+	agent, err := New(&config.Config{
+		UpdateFrequency: 2,
+		Containers: []config.Container{
+			{Name: "slow", Checks: []config.Check{{Type: "exec", Command: []string{"true"}}}},
+		},
+	}, stdout.New(), m)
+	require.Nil(t, err)
+
+	m.
+		EXPECT().
+		ContainerList(gomock.Any(), types.ContainerListOptions{}).
+		Return([]types.Container{{ID: "1", Names: []string{"/slow"}, State: "running"}}, nil)
+	m.
+		EXPECT().
+		ContainerStatsOneShot(gomock.Any(), "1").
+		Return(newContainerStats(), nil)
+	m.
+		EXPECT().
+		ContainerExecCreate(gomock.Any(), "1", gomock.Any()).
+		DoAndReturn(func(ctx context.Context, id string, _ types.ExecConfig) (types.IDResponse, error) {
+			<-ctx.Done()
+			return types.IDResponse{}, ctx.Err()
+		})
+
+	// The health check shares the container's deadline, which is shorter than
+	// the default check timeout
+	start := time.Now()
+	metrics, err := agent.getDockerContainerMetrics(context.Background())
+	require.Nil(t, err)
+	require.True(t, time.Since(start) < 2*time.Second)
+	require.Equal(t, "context deadline exceeded", metrics[0].HealthChecks[0].Message)
+}
+
+func TestGetDockerContainerMetricsPartial(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := testutils.NewMockAPIClient(ctrl)
+	expectInspect(m)
+	agent := newAgent(m)
+
+	containers := []types.Container{
+		{ID: "1", Names: []string{"/gone"}, State: "running"},
+		{ID: "2", Names: []string{"/broken"}, State: "running"},
+		{ID: "3", Names: []string{"/ok"}, State: "running"},
+	}
+
+	m.
+		EXPECT().
+		ContainerList(gomock.Any(), types.ContainerListOptions{}).
+		Return(containers, nil)
+	m.
+		EXPECT().
+		ContainerStatsOneShot(gomock.Any(), "1").
+		Return(types.ContainerStats{}, fmt.Errorf("Error: No such container: 1"))
+	m.
+		EXPECT().
+		ContainerStatsOneShot(gomock.Any(), "2").
+		Return(types.ContainerStats{Body: io.NopCloser(bytes.NewBufferString("{"))}, nil)
+	m.
+		EXPECT().
+		ContainerStatsOneShot(gomock.Any(), "3").
+		Return(newContainerStats(), nil)
+
+	metrics, err := agent.getDockerContainerMetrics(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 3, len(metrics))
+	require.Equal(t, "gone", metrics[0].Name)
+	require.Equal(t, "Error: No such container: 1", metrics[0].Error)
+	require.False(t, metrics[0].Timestamp.IsZero())
+	require.Equal(t, "unexpected end of JSON input", metrics[1].Error)
+	require.Equal(t, "", metrics[2].Error)
+	require.Equal(t, 37188, metrics[2].NetworkIORead)
 }
 
 func TestSleep(t *testing.T) {
 	c := &config.Config{
 		UpdateFrequency: 1,
 	}
-	agent := New(c, stdout.New(), nil)
+	agent, err := New(c, stdout.New(), nil)
+	require.Nil(t, err)
 
 	timeNow := time.Now()
-	agent.sleep()
+	agent.sleep(context.Background())
 	timeAfter := time.Now()
 
 	require.True(t, timeAfter.Sub(timeNow) >= time.Second)
 }
+
+func TestSleepCanceled(t *testing.T) {
+	c := &config.Config{
+		UpdateFrequency: 60,
+	}
+	agent, err := New(c, stdout.New(), nil)
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	timeNow := time.Now()
+	agent.sleep(ctx)
+	require.True(t, time.Since(timeNow) < time.Second)
+}
+
+func TestRunShutdown(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	m := testutils.NewMockAPIClient(ctrl)
+
+	b := &closingBackend{}
+	agent, err := New(&config.Config{UpdateFrequency: 60}, b, m)
+	require.Nil(t, err)
+
+	m.EXPECT().Close().Return(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		agent.Run(ctx)
+		close(done)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+	require.True(t, b.closed)
+}
+
+func TestDetach(t *testing.T) {
+	agent, err := New(&config.Config{ShutdownTimeout: 1}, stdout.New(), nil)
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	detached, cancelDetached := agent.detach(ctx)
+	defer cancelDetached()
+
+	// The send in flight survives the agent being stopped for the shutdown timeout
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	require.Nil(t, detached.Err())
+
+	select {
+	case <-detached.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("detached context was not canceled after the shutdown timeout")
+	}
+
+	detached, cancelDetached = agent.detach(context.Background())
+	cancelDetached()
+	require.NotNil(t, detached.Err())
+}
+
+func TestNewAgentIDNotStored(t *testing.T) {
+	dir := t.TempDir()
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "config"), nil, 0644))
+
+	// The agent still starts if the ID can not be stored
+	agent, err := New(&config.Config{AgentIDFile: filepath.Join(dir, "config", "agent-id")}, stdout.New(), nil)
+	require.Nil(t, err)
+	require.NotEmpty(t, agent.agentID)
+
+	idFile := filepath.Join(dir, "agent-id")
+	agent, err = New(&config.Config{AgentIDFile: idFile}, nil, nil, WithoutPersistentID())
+	require.Nil(t, err)
+	require.NotEmpty(t, agent.agentID)
+	_, err = os.Stat(idFile)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestGetHost(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	m := testutils.NewMockAPIClient(ctrl)
+
+	idFile := filepath.Join(t.TempDir(), "agent-id")
+	agent, err := New(&config.Config{UpdateFrequency: 2, AgentIDFile: idFile}, stdout.New(), m)
+	require.Nil(t, err)
+
+	m.
+		EXPECT().
+		ServerVersion(gomock.Any()).
+		Return(types.Version{Version: "24.0.5"}, nil)
+
+	host := agent.getHost(context.Background())
+	require.NotEqual(t, "", host.AgentID)
+	require.Equal(t, "24.0.5", host.DockerVersion)
+
+	// The ID is kept across restarts
+	restarted, err := New(&config.Config{UpdateFrequency: 2, AgentIDFile: idFile}, stdout.New(), m)
+	require.Nil(t, err)
+	require.Equal(t, host.AgentID, restarted.agentID)
+}
+
+func TestGetDockerContainerMetricsFilters(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := testutils.NewMockAPIClient(ctrl)
+	agent := newAgent(m)
+	agent.SetFilters(filters.NewArgs(filters.Arg("name", "web")))
+
+	m.
+		EXPECT().
+		ContainerList(gomock.Any(), types.ContainerListOptions{
+			Filters: filters.NewArgs(filters.Arg("name", "web")),
+		}).
+		Return([]types.Container{}, nil)
+
+	metrics, err := agent.getDockerContainerMetrics(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 0, len(metrics))
+}
+
+func TestGetDockerContainerMetricsStopped(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := testutils.NewMockAPIClient(ctrl)
+	agent := newAgent(m)
+	agent.Config.AllContainers = true
+
+	m.
+		EXPECT().
+		ContainerList(gomock.Any(), types.ContainerListOptions{All: true}).
+		Return([]types.Container{
+			{ID: "1", Names: []string{"/web"}, State: "running"},
+			{ID: "2", Names: []string{"/crashed"}, State: "exited"},
+			{ID: "3", Names: []string{"/new"}, State: "created"},
+		}, nil)
+	m.
+		EXPECT().
+		ContainerStatsOneShot(gomock.Any(), "1").
+		Return(newContainerStats(), nil)
+	m.
+		EXPECT().
+		ContainerInspect(gomock.Any(), "1").
+		Return(types.ContainerJSON{}, nil)
+	m.
+		EXPECT().
+		ContainerInspect(gomock.Any(), "2").
+		Return(types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				RestartCount: 3,
+				State: &types.ContainerState{
+					Status:     "exited",
+					ExitCode:   137,
+					FinishedAt: "2023-02-20T10:03:01.998224131Z",
+				},
+			},
+		}, nil)
+	m.
+		EXPECT().
+		ContainerInspect(gomock.Any(), "3").
+		Return(types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				State: &types.ContainerState{
+					Status:     "created",
+					FinishedAt: "0001-01-01T00:00:00Z",
+				},
+			},
+		}, nil)
+
+	metrics, err := agent.getDockerContainerMetrics(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 3, len(metrics))
+	require.Nil(t, metrics[0].ExitCode)
+	require.Equal(t, 37188, metrics[0].NetworkIORead)
+
+	require.Equal(t, "exited", metrics[1].State)
+	require.Equal(t, 137, *metrics[1].ExitCode)
+	require.Equal(t, 3, metrics[1].RestartCount)
+	require.Equal(t, time.Date(2023, 2, 20, 10, 3, 1, 998224131, time.UTC), *metrics[1].FinishedAt)
+	require.Equal(t, 0, metrics[1].NetworkIORead)
+	require.False(t, metrics[1].HasStats())
+
+	require.Equal(t, "created", metrics[2].State)
+	require.Nil(t, metrics[2].ExitCode)
+	require.Nil(t, metrics[2].FinishedAt)
+}
+
+func TestGetDockerContainerMetricsRestarted(t *testing.T) {
+	ctrl := gomock.NewController(t)
+
+	m := testutils.NewMockAPIClient(ctrl)
+	agent := newAgent(m)
+
+	inspect := func(startedAt string) types.ContainerJSON {
+		return types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				State: &types.ContainerState{Status: "running", StartedAt: startedAt},
+			},
+		}
+	}
+	m.
+		EXPECT().
+		ContainerInspect(gomock.Any(), "1").
+		Return(inspect("2023-02-20T10:00:00Z"), nil)
+	m.
+		EXPECT().
+		ContainerInspect(gomock.Any(), "1").
+		Return(inspect("2023-02-20T10:05:00Z"), nil)
+	m.
+		EXPECT().
+		ContainerList(gomock.Any(), types.ContainerListOptions{}).
+		Return([]types.Container{{ID: "1", Names: []string{"/web"}, State: "running"}}, nil)
+	m.
+		EXPECT().
+		ContainerStatsOneShot(gomock.Any(), "1").
+		Return(newContainerStats(), nil)
+
+	// The container was inspected and sampled before it restarted
+	_, err := agent.inspect.container(context.Background(), "1", "running")
+	require.Nil(t, err)
+	agent.rates.update("1", sample{rxBytes: 1 << 40})
+
+	metrics, err := agent.getDockerContainerMetrics(context.Background())
+	require.Nil(t, err)
+	require.True(t, metrics[0].CounterReset)
+	require.Equal(t, time.Date(2023, 2, 20, 10, 5, 0, 0, time.UTC), *metrics[0].StartedAt)
+}
@@ -0,0 +1,102 @@
+package agent
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+)
+
+// sample holds the counters of a container at the time its stats were read
+type sample struct {
+	read      time.Time
+	rxBytes   int
+	txBytes   int
+	rxPackets int
+	txPackets int
+	blkRead   int
+	blkWrite  int
+
+	cpuPeriods          int
+	cpuThrottledPeriods int
+	// cpuThrottledTime is in nanoseconds
+	cpuThrottledTime int
+}
+
+// counters returns the counters in a fixed order
+func (s *sample) counters() []int {
+	return []int{
+		s.rxBytes, s.txBytes, s.rxPackets, s.txPackets, s.blkRead, s.blkWrite,
+		s.cpuPeriods, s.cpuThrottledPeriods, s.cpuThrottledTime,
+	}
+}
+
+// rateTracker remembers the previous sample of every container to turn the
+// cumulative counters into per second rates
+type rateTracker struct {
+	mu      sync.Mutex
+	samples map[string]sample
+}
+
+func newRateTracker() *rateTracker {
+	return &rateTracker{
+		samples: map[string]sample{},
+	}
+}
+
+// update stores the sample and returns the rates since the previous one
+// The rates are nil for the first sample of a container and if any counter
+// went backwards, in which case reset is true
+func (r *rateTracker) update(id string, cur sample) (rates *data.ContainerRates, reset bool) {
+	r.mu.Lock()
+	prev, ok := r.samples[id]
+	r.samples[id] = cur
+	r.mu.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	prevCounters := prev.counters()
+	for i, v := range cur.counters() {
+		if v < prevCounters[i] {
+			return nil, true
+		}
+	}
+
+	interval := cur.read.Sub(prev.read).Seconds()
+	if interval <= 0 {
+		return nil, false
+	}
+
+	perSecond := func(cur, prev int) float64 {
+		return float64(cur-prev) / interval
+	}
+	var throttled float64
+	if periods := cur.cpuPeriods - prev.cpuPeriods; periods > 0 {
+		throttled = float64(cur.cpuThrottledPeriods-prev.cpuThrottledPeriods) / float64(periods) * 100
+	}
+	return &data.ContainerRates{
+		Interval:               interval,
+		NetworkRxBytes:         perSecond(cur.rxBytes, prev.rxBytes),
+		NetworkTxBytes:         perSecond(cur.txBytes, prev.txBytes),
+		NetworkRxPackets:       perSecond(cur.rxPackets, prev.rxPackets),
+		NetworkTxPackets:       perSecond(cur.txPackets, prev.txPackets),
+		BlockIORead:            perSecond(cur.blkRead, prev.blkRead),
+		BlockIOWrite:           perSecond(cur.blkWrite, prev.blkWrite),
+		CPUThrottledPercentage: throttled,
+		CPUThrottledTime:       perSecond(cur.cpuThrottledTime, prev.cpuThrottledTime) / 1e9,
+	}, false
+}
+
+// prune forgets the samples of containers that are no longer listed
+func (r *rateTracker) prune(ids map[string]bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id := range r.samples {
+		if !ids[id] {
+			delete(r.samples, id)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateTracker(t *testing.T) {
+	r := newRateTracker()
+	start := time.Date(2023, 2, 20, 10, 3, 0, 0, time.UTC)
+
+	rates, reset := r.update("1", sample{read: start, rxBytes: 1000, txPackets: 10, blkWrite: 4096})
+	require.Nil(t, rates)
+	require.False(t, reset)
+
+	rates, reset = r.update("1", sample{read: start.Add(2 * time.Second), rxBytes: 3000, txPackets: 30, blkWrite: 8192})
+	require.False(t, reset)
+	require.Equal(t, 2.0, rates.Interval)
+	require.Equal(t, 1000.0, rates.NetworkRxBytes)
+	require.Equal(t, 10.0, rates.NetworkTxPackets)
+	require.Equal(t, 2048.0, rates.BlockIOWrite)
+	require.Equal(t, 0.0, rates.BlockIORead)
+
+	// The container restarted and its counters started over
+	rates, reset = r.update("1", sample{read: start.Add(4 * time.Second), rxBytes: 100, txPackets: 1})
+	require.Nil(t, rates)
+	require.True(t, reset)
+
+	rates, reset = r.update("1", sample{read: start.Add(5 * time.Second), rxBytes: 600, txPackets: 1})
+	require.False(t, reset)
+	require.Equal(t, 500.0, rates.NetworkRxBytes)
+}
+
+func TestRateTrackerSameRead(t *testing.T) {
+	r := newRateTracker()
+	start := time.Date(2023, 2, 20, 10, 3, 0, 0, time.UTC)
+
+	r.update("1", sample{read: start})
+	rates, reset := r.update("1", sample{read: start})
+	require.Nil(t, rates)
+	require.False(t, reset)
+}
+
+func TestRateTrackerPrune(t *testing.T) {
+	r := newRateTracker()
+	r.update("1", sample{})
+	r.update("2", sample{})
+
+	r.prune(map[string]bool{"2": true})
+	require.Equal(t, 1, len(r.samples))
+	_, ok := r.samples["2"]
+	require.True(t, ok)
+}
+
+func TestRateTrackerThrottling(t *testing.T) {
+	r := newRateTracker()
+	start := time.Date(2023, 2, 20, 10, 3, 0, 0, time.UTC)
+
+	r.update("1", sample{read: start, cpuPeriods: 100, cpuThrottledPeriods: 10, cpuThrottledTime: 1e9})
+	rates, reset := r.update("1", sample{
+		read:                start.Add(2 * time.Second),
+		cpuPeriods:          120,
+		cpuThrottledPeriods: 20,
+		cpuThrottledTime:    2e9,
+	})
+	require.False(t, reset)
+	require.Equal(t, 50.0, rates.CPUThrottledPercentage)
+	require.Equal(t, 0.5, rates.CPUThrottledTime)
+}
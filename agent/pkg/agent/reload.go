@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/backend"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/config"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/healthcheck"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/host"
+	"github.com/sirupsen/logrus"
+)
+
+// BackendFactory creates the backend described by a config
+type BackendFactory func(c *config.Config) (backend.Backend, error)
+
+// Reload switches the agent to a new, already validated config
+// It waits for the poll in flight to be sent first. The backend is only
+// recreated if its configuration changed; the old one is closed before the new
+// one is created so it can flush its queues and free its listen addresses.
+// Polls do not wait for that, their metrics are held and sent once the new
+// backend is up. If the new backend can not be created the agent keeps
+// running on the old config and the error is returned
+func (a *Agent) Reload(c *config.Config, newBackend BackendFactory) error {
+	a.reloadMu.Lock()
+	defer a.reloadMu.Unlock()
+
+	// Keep the health runner if the checks did not change, it counts the
+	// consecutive polls metric checks were over their threshold
+	health := a.health
+	if !reflect.DeepEqual(a.Config.Containers, c.Containers) {
+		health = nil
+		if len(c.Containers) > 0 {
+			var err error
+			health, err = healthcheck.New(c.Containers, a.docker)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	filter, err := newContainerFilter(c.Include, c.Exclude)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	if !backendChanged(a.Config, c) {
+		a.apply(c, a.backend, health, filter)
+		a.mu.Unlock()
+		return nil
+	}
+	old := a.backend
+	a.backend = nil
+	a.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.shutdownTimeout())
+	defer cancel()
+	err = backend.Close(ctx, old)
+	if err != nil {
+		logrus.Errorf("failed to close backend: %v", err)
+	}
+
+	b, err := newBackend(c)
+	if err != nil {
+		// Bring the old backend back up, it worked before
+		restored, oldErr := newBackend(a.Config)
+		if oldErr != nil {
+			return fmt.Errorf("%v, failed to restore the old backend: %v", err, oldErr)
+		}
+		a.mu.Lock()
+		a.backend = restored
+		a.mu.Unlock()
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.apply(c, b, health, filter)
+	return nil
+}
+
+// apply makes c the current config, a.mu must be held for writing
+func (a *Agent) apply(c *config.Config, b backend.Backend, health *healthcheck.Runner, filter *containerFilter) {
+	if c.HostRoot != a.Config.HostRoot {
+		a.host = host.New(c.HostRoot, a.agentID)
+	}
+	a.Config = c
+	a.backend = b
+	a.health = health
+	a.filter = filter
+
+	// Only start or stop the event watcher once Run has started it
+	if a.runCtx == nil {
+		return
+	}
+	if c.Events && a.events == nil {
+		a.startEvents()
+	}
+	if !c.Events && a.events != nil {
+		a.eventsBuffer = append(a.eventsBuffer, a.events.drain()...)
+		a.stopEvents()
+		a.events = nil
+	}
+}
+
+// startEvents starts watching for container events, a.mu must be held for writing
+func (a *Agent) startEvents() {
+	ctx, cancel := context.WithCancel(a.runCtx)
+	a.events = newEventWatcher(a.docker)
+	a.stopEvents = cancel
+	go a.events.watch(ctx)
+}
+
+// drainEvents returns the events to send with the current poll
+func (a *Agent) drainEvents() []*data.ContainerEvent {
+	events := a.eventsBuffer
+	a.eventsBuffer = nil
+	if a.events != nil {
+		events = append(events, a.events.drain()...)
+	}
+	return events
+}
+
+// backendChanged returns true if the backends need to be recreated for c
+func backendChanged(old, c *config.Config) bool {
+	return !reflect.DeepEqual(old.Backends, c.Backends) || !reflect.DeepEqual(old.Spool, c.Spool)
+}
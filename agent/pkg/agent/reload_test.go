@@ -0,0 +1,196 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/dockwizard/dockwizard_agent/agent/internal/testutils"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/backend"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/config"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+type closingBackend struct {
+	name   string
+	closed bool
+}
+
+func (c *closingBackend) SendData(_ context.Context, _ *data.Metrics) error {
+	return nil
+}
+
+func (c *closingBackend) Close(_ context.Context) error {
+	c.closed = true
+	return nil
+}
+
+// slowBackend records what it was sent and blocks in Close until release
+// is closed
+type slowBackend struct {
+	closing chan struct{}
+	release chan struct{}
+	sent    int
+}
+
+func (s *slowBackend) SendData(_ context.Context, _ *data.Metrics) error {
+	s.sent++
+	return nil
+}
+
+func (s *slowBackend) Close(_ context.Context) error {
+	close(s.closing)
+	<-s.release
+	return nil
+}
+
+func newReloadConfig(backendName string, frequency int) *config.Config {
+	return &config.Config{
+		UpdateFrequency: frequency,
+		Backends:        []config.Backend{{Name: backendName, Type: "stdout"}},
+	}
+}
+
+func TestReloadSameBackend(t *testing.T) {
+	old := &closingBackend{name: "old"}
+	agent, err := New(newReloadConfig("a", 2), old, nil)
+	require.Nil(t, err)
+
+	factory := func(c *config.Config) (backend.Backend, error) {
+		t.Fatal("backend should not be recreated")
+		return nil, nil
+	}
+	err = agent.Reload(newReloadConfig("a", 10), factory)
+	require.Nil(t, err)
+	require.Equal(t, 10, agent.Config.UpdateFrequency)
+	require.Equal(t, old, agent.backend)
+	require.False(t, old.closed)
+}
+
+func TestReloadNewBackend(t *testing.T) {
+	old := &closingBackend{name: "old"}
+	agent, err := New(newReloadConfig("a", 2), old, nil)
+	require.Nil(t, err)
+
+	factory := func(c *config.Config) (backend.Backend, error) {
+		return &closingBackend{name: c.Backends[0].Name}, nil
+	}
+	err = agent.Reload(newReloadConfig("b", 2), factory)
+	require.Nil(t, err)
+	require.True(t, old.closed)
+	require.Equal(t, "b", agent.backend.(*closingBackend).name)
+}
+
+func TestReloadNewBackendFails(t *testing.T) {
+	old := &closingBackend{name: "old"}
+	c := newReloadConfig("a", 2)
+	agent, err := New(c, old, nil)
+	require.Nil(t, err)
+
+	factory := func(c *config.Config) (backend.Backend, error) {
+		if c.Backends[0].Name == "b" {
+			return nil, fmt.Errorf("address already in use")
+		}
+		return &closingBackend{name: c.Backends[0].Name}, nil
+	}
+	err = agent.Reload(newReloadConfig("b", 10), factory)
+	require.EqualError(t, err, "address already in use")
+	require.Equal(t, c, agent.Config)
+	require.Equal(t, "a", agent.backend.(*closingBackend).name)
+}
+
+func TestReloadClosesOutsideLock(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	m := testutils.NewMockAPIClient(ctrl)
+	m.EXPECT().ContainerList(gomock.Any(), gomock.Any()).Return(nil, nil).AnyTimes()
+	m.EXPECT().ServerVersion(gomock.Any()).Return(types.Version{}, nil).AnyTimes()
+
+	old := &slowBackend{closing: make(chan struct{}), release: make(chan struct{})}
+	agent, err := New(newReloadConfig("a", 2), old, m)
+	require.Nil(t, err)
+
+	next := &slowBackend{}
+	done := make(chan error)
+	go func() {
+		done <- agent.Reload(newReloadConfig("b", 2), func(c *config.Config) (backend.Backend, error) {
+			return next, nil
+		})
+	}()
+
+	// Polls do not wait for the old backend to close, their metrics are held
+	<-old.closing
+	agent.poll(context.Background())
+	require.Equal(t, 0, old.sent)
+	require.Equal(t, 1, len(agent.held))
+
+	close(old.release)
+	require.Nil(t, <-done)
+	agent.poll(context.Background())
+	require.Equal(t, 2, next.sent)
+	require.Equal(t, 0, len(agent.held))
+}
+
+func TestReloadKeepsHealthRunner(t *testing.T) {
+	c := newReloadConfig("a", 2)
+	c.Containers = []config.Container{{Name: "web", Checks: []config.Check{{Type: "metric", Metric: "cpu", Threshold: 50}}}}
+	agent, err := New(c, &closingBackend{}, nil)
+	require.Nil(t, err)
+	health := agent.health
+
+	next := newReloadConfig("a", 10)
+	next.Containers = c.Containers
+	require.Nil(t, agent.Reload(next, nil))
+	require.Same(t, health, agent.health)
+
+	changed := newReloadConfig("a", 10)
+	changed.Containers = []config.Container{{Name: "db", Checks: c.Containers[0].Checks}}
+	require.Nil(t, agent.Reload(changed, nil))
+	require.NotSame(t, health, agent.health)
+
+	require.Nil(t, agent.Reload(newReloadConfig("a", 10), nil))
+	require.Nil(t, agent.health)
+}
+
+func TestReloadInvalidHealthCheck(t *testing.T) {
+	c := newReloadConfig("a", 2)
+	agent, err := New(c, &closingBackend{}, nil)
+	require.Nil(t, err)
+
+	next := newReloadConfig("a", 2)
+	next.Containers = []config.Container{{Regex: "("}}
+	err = agent.Reload(next, nil)
+	require.NotNil(t, err)
+	require.Equal(t, c, agent.Config)
+}
+
+func TestReloadEvents(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	m := testutils.NewMockAPIClient(ctrl)
+
+	msgs := make(chan events.Message)
+	errs := make(chan error)
+	m.EXPECT().
+		Events(gomock.Any(), gomock.Any()).
+		Return((<-chan events.Message)(msgs), (<-chan error)(errs)).
+		AnyTimes()
+
+	agent, err := New(newReloadConfig("a", 2), &closingBackend{}, m)
+	require.Nil(t, err)
+	agent.runCtx = context.Background()
+
+	next := newReloadConfig("a", 2)
+	next.Events = true
+	require.Nil(t, agent.Reload(next, nil))
+	require.NotNil(t, agent.events)
+
+	// Events received before the watcher is stopped are still sent
+	agent.events.pending = append(agent.events.pending, &data.ContainerEvent{Action: "start"})
+	require.Nil(t, agent.Reload(newReloadConfig("a", 2), nil))
+	require.Nil(t, agent.events)
+	require.Equal(t, 1, len(agent.drainEvents()))
+	require.Equal(t, 0, len(agent.drainEvents()))
+}
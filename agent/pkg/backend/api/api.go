@@ -2,88 +2,263 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"time"
 
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/backend/httpsend"
 	"github.com/dockwizard/dockwizard_agent/agent/pkg/config"
 	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
 )
 
 type api struct {
-	config   *config.Config
+	config   *config.Backend
 	client   *http.Client
 	endpoint string
+	now      func() time.Time
 }
 
 type AgentMetadata struct {
-	ContainerID    string `json:"container_id"`
-	ContainerName  string `json:"container_name"`
-	ContainerImage string `json:"container_image"`
-	ContainerState string `json:"container_state"`
+	ContainerID    string            `json:"container_id"`
+	ContainerName  string            `json:"container_name"`
+	ContainerImage string            `json:"container_image"`
+	ContainerState string            `json:"container_state"`
+	HealthStatus   string            `json:"health_status,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	ComposeProject string            `json:"compose_project,omitempty"`
+	ComposeService string            `json:"compose_service,omitempty"`
+	SwarmService   string            `json:"swarm_service,omitempty"`
+	SwarmStack     string            `json:"swarm_stack,omitempty"`
+	ImageID        string            `json:"image_id,omitempty"`
+	ImageDigest    string            `json:"image_digest,omitempty"`
+	Created        *time.Time        `json:"created,omitempty"`
+	StartedAt      *time.Time        `json:"started_at,omitempty"`
+	RestartPolicy  string            `json:"restart_policy,omitempty"`
 }
 
 type AgentData struct {
-	CPU              float64 `json:"cpu"`
-	MemoryPercentage float64 `json:"memory_perc"`
-	MemoryTotal      int     `json:"memory_tot"`
-	TotalRx          int     `json:"total_rx"`
-	TotalTx          int     `json:"total_tx"`
-	IoRead           int     `json:"io_read"`
-	IoWrite          int     `json:"io_write"`
+	CPU                 float64   `json:"cpu"`
+	CPUUser             float64   `json:"cpu_user"`
+	CPUSystem           float64   `json:"cpu_system"`
+	PerCPU              []float64 `json:"per_cpu,omitempty"`
+	CPULimit            float64   `json:"cpu_limit,omitempty"`
+	CPUPeriods          int       `json:"cpu_periods"`
+	CPUThrottledPeriods int       `json:"cpu_throttled_periods"`
+	CPUThrottledTime    int       `json:"cpu_throttled_time"`
+	CPUThrottled        float64   `json:"cpu_throttled_perc"`
+	PIDs                int       `json:"pids"`
+	PIDsLimit           int       `json:"pids_limit,omitempty"`
+	MemoryPercentage    float64   `json:"memory_perc"`
+	MemoryTotal         int       `json:"memory_tot"`
+	TotalRx             int       `json:"total_rx"`
+	TotalTx             int       `json:"total_tx"`
+	IoRead              int       `json:"io_read"`
+	IoWrite             int       `json:"io_write"`
+}
+
+type AgentRates struct {
+	Interval  float64 `json:"interval"`
+	RxBytes   float64 `json:"rx_bytes"`
+	TxBytes   float64 `json:"tx_bytes"`
+	RxPackets float64 `json:"rx_packets"`
+	TxPackets float64 `json:"tx_packets"`
+	IoRead    float64 `json:"io_read"`
+	IoWrite   float64 `json:"io_write"`
+
+	CPUThrottled     float64 `json:"cpu_throttled_perc"`
+	CPUThrottledTime float64 `json:"cpu_throttled_time"`
+}
+
+type AgentHealthCheck struct {
+	Type    string `json:"type"`
+	Target  string `json:"target"`
+	Healthy bool   `json:"healthy"`
+	Message string `json:"message,omitempty"`
 }
 
 type AgentObject struct {
-	Timestamp time.Time      `json:"timestamp"`
-	Metadata  *AgentMetadata `json:"metadata"`
-	Data      *AgentData     `json:"data"`
+	Timestamp    time.Time           `json:"timestamp"`
+	PreRead      *time.Time          `json:"preread,omitempty"`
+	Metadata     *AgentMetadata      `json:"metadata"`
+	Data         *AgentData          `json:"data"`
+	Rates        *AgentRates         `json:"rates,omitempty"`
+	CounterReset bool                `json:"counter_reset,omitempty"`
+	Error        string              `json:"error,omitempty"`
+	HealthChecks []*AgentHealthCheck `json:"health_checks,omitempty"`
+	ExitCode     *int                `json:"exit_code,omitempty"`
+	FinishedAt   *time.Time          `json:"finished_at,omitempty"`
+	RestartCount int                 `json:"restart_count,omitempty"`
 }
 
-type AgentObjectList struct {
-	Data []*AgentObject `json:"data"`
+type AgentEvent struct {
+	Timestamp      time.Time `json:"timestamp"`
+	ContainerID    string    `json:"container_id"`
+	ContainerName  string    `json:"container_name"`
+	ContainerImage string    `json:"container_image"`
+	Action         string    `json:"action"`
+	ExitCode       *int      `json:"exit_code,omitempty"`
+	Signal         string    `json:"signal,omitempty"`
+	HealthStatus   string    `json:"health_status,omitempty"`
 }
 
-func New(endpoint string, config *config.Config, client *http.Client) *api {
-	if client == nil {
-		client = &http.Client{
-			Timeout: 25 * time.Second,
-		}
-	}
+type AgentHost struct {
+	AgentID          string    `json:"agent_id"`
+	Hostname         string    `json:"hostname"`
+	OS               string    `json:"os"`
+	Kernel           string    `json:"kernel"`
+	DockerVersion    string    `json:"docker_version"`
+	Timestamp        time.Time `json:"timestamp"`
+	CPUs             int       `json:"cpus"`
+	CPU              float64   `json:"cpu"`
+	MemoryTotal      int       `json:"memory_tot"`
+	MemoryUsed       int       `json:"memory_used"`
+	MemoryPercentage float64   `json:"memory_perc"`
+	Load1            float64   `json:"load1"`
+	Load5            float64   `json:"load5"`
+	Load15           float64   `json:"load15"`
+	DiskTotal        int       `json:"disk_tot"`
+	DiskUsed         int       `json:"disk_used"`
+	DiskPercentage   float64   `json:"disk_perc"`
+	Error            string    `json:"error,omitempty"`
+}
+
+type AgentObjectList struct {
+	Host   *AgentHost     `json:"host,omitempty"`
+	Data   []*AgentObject `json:"data"`
+	Events []*AgentEvent  `json:"events,omitempty"`
+}
 
+func New(config *config.Backend, client *http.Client) *api {
 	return &api{
 		config:   config,
-		client:   client,
-		endpoint: endpoint,
+		client:   httpsend.Client(client),
+		endpoint: config.APIEndpoint,
+		now:      time.Now,
 	}
 }
 
-func (a *api) SendData(metrics *data.Metrics) error {
+func (a *api) SendData(ctx context.Context, metrics *data.Metrics) error {
 	var list []*AgentObject
 	for _, container := range metrics.Container {
+		var healthChecks []*AgentHealthCheck
+		for _, check := range container.HealthChecks {
+			healthChecks = append(healthChecks, &AgentHealthCheck{
+				Type:    check.Type,
+				Target:  check.Target,
+				Healthy: check.Healthy,
+				Message: check.Message,
+			})
+		}
+
+		var rates *AgentRates
+		if container.Rates != nil {
+			rates = &AgentRates{
+				Interval:  container.Rates.Interval,
+				RxBytes:   container.Rates.NetworkRxBytes,
+				TxBytes:   container.Rates.NetworkTxBytes,
+				RxPackets: container.Rates.NetworkRxPackets,
+				TxPackets: container.Rates.NetworkTxPackets,
+				IoRead:    container.Rates.BlockIORead,
+				IoWrite:   container.Rates.BlockIOWrite,
+
+				CPUThrottled:     container.Rates.CPUThrottledPercentage,
+				CPUThrottledTime: container.Rates.CPUThrottledTime,
+			}
+		}
+
 		list = append(list, &AgentObject{
-			Timestamp: time.Now(),
+			Timestamp: container.Timestamp,
+			PreRead:   container.PreRead,
 			Metadata: &AgentMetadata{
 				ContainerID:    container.ID,
 				ContainerName:  container.Name,
 				ContainerImage: container.Image,
 				ContainerState: container.State,
+				HealthStatus:   container.HealthStatus,
+				Labels:         container.Labels,
+				ComposeProject: container.ComposeProject,
+				ComposeService: container.ComposeService,
+				SwarmService:   container.SwarmService,
+				SwarmStack:     container.SwarmStack,
+				ImageID:        container.ImageID,
+				ImageDigest:    container.ImageDigest,
+				Created:        container.Created,
+				StartedAt:      container.StartedAt,
+				RestartPolicy:  container.RestartPolicy,
 			},
 			Data: &AgentData{
-				CPU:              container.CPUUsage,
-				MemoryTotal:      container.MemoryUsage,
-				MemoryPercentage: container.MemoryUsagePercentage,
-				TotalRx:          container.NetworkIORead,
-				TotalTx:          container.NetworkIOWrite,
-				IoRead:           container.BlockIORead,
-				IoWrite:          container.BlockIOWrite,
+				CPU:                 container.CPUUsage,
+				CPUUser:             container.CPUUserPercentage,
+				CPUSystem:           container.CPUSystemPercentage,
+				PerCPU:              container.PerCPUUsage,
+				CPULimit:            container.CPULimit,
+				CPUPeriods:          container.CPUPeriods,
+				CPUThrottledPeriods: container.CPUThrottledPeriods,
+				CPUThrottledTime:    container.CPUThrottledTime,
+				CPUThrottled:        container.CPUThrottledPercentage,
+				PIDs:                container.PIDs,
+				PIDsLimit:           container.PIDsLimit,
+				MemoryTotal:         container.MemoryUsage,
+				MemoryPercentage:    container.MemoryUsagePercentage,
+				TotalRx:             container.NetworkIORead,
+				TotalTx:             container.NetworkIOWrite,
+				IoRead:              container.BlockIORead,
+				IoWrite:             container.BlockIOWrite,
 			},
+			Rates:        rates,
+			CounterReset: container.CounterReset,
+			Error:        container.Error,
+			HealthChecks: healthChecks,
+			ExitCode:     container.ExitCode,
+			FinishedAt:   container.FinishedAt,
+			RestartCount: container.RestartCount,
+		})
+	}
+
+	var events []*AgentEvent
+	for _, event := range metrics.Events {
+		events = append(events, &AgentEvent{
+			Timestamp:      event.Timestamp,
+			ContainerID:    event.ID,
+			ContainerName:  event.Name,
+			ContainerImage: event.Image,
+			Action:         event.Action,
+			ExitCode:       event.ExitCode,
+			Signal:         event.Signal,
+			HealthStatus:   event.HealthStatus,
 		})
 	}
 
+	var host *AgentHost
+	if h := metrics.Host; h != nil {
+		host = &AgentHost{
+			AgentID:          h.AgentID,
+			Hostname:         h.Hostname,
+			OS:               h.OS,
+			Kernel:           h.Kernel,
+			DockerVersion:    h.DockerVersion,
+			Timestamp:        h.Timestamp,
+			CPUs:             h.CPUs,
+			CPU:              h.CPUUsage,
+			MemoryTotal:      h.MemoryTotal,
+			MemoryUsed:       h.MemoryUsage,
+			MemoryPercentage: h.MemoryUsagePercentage,
+			Load1:            h.Load1,
+			Load5:            h.Load5,
+			Load15:           h.Load15,
+			DiskTotal:        h.DiskTotal,
+			DiskUsed:         h.DiskUsage,
+			DiskPercentage:   h.DiskUsagePercentage,
+			Error:            h.Error,
+		}
+	}
+
 	agentObjectList := &AgentObjectList{
-		Data: list,
+		Host:   host,
+		Data:   list,
+		Events: events,
 	}
 
 	jsonData, err := json.Marshal(agentObjectList)
@@ -91,23 +266,43 @@ func (a *api) SendData(metrics *data.Metrics) error {
 		return err
 	}
 
-	req, err := http.NewRequest("POST", a.endpoint, bytes.NewBuffer(jsonData))
+	body, err := httpsend.Compress(a.config.Compression, jsonData)
+	if err != nil {
+		return err
+	}
+
+	return a.sendWithRetry(ctx, body)
+}
+
+// post makes a single attempt at sending the body
+func (a *api) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", a.endpoint, bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", a.config.APIKey))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	if a.config.Compression != "" && a.config.Compression != "none" {
+		req.Header.Set("Content-Encoding", a.config.Compression)
+	}
 	res, err := a.client.Do(req)
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 
-	bts, err := io.ReadAll(res.Body)
+	bts, err := readBody(res)
 	if err != nil {
 		return err
 	}
 
 	if res.StatusCode != 200 {
-		return fmt.Errorf("response: %s", string(bts))
+		return &statusError{
+			code:       res.StatusCode,
+			body:       string(bts),
+			retryAfter: parseRetryAfter(res.Header.Get("Retry-After"), a.now()),
+		}
 	}
 
 	return nil
@@ -1,16 +1,90 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/dockwizard/dockwizard_agent/agent/pkg/config"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
 	"github.com/stretchr/testify/require"
 )
 
 func TestNew(t *testing.T) {
-	c := &config.Config{}
-	a := New("http://localhost:8080", c, nil)
+	c := &config.Backend{APIEndpoint: "http://localhost:8080"}
+	a := New(c, nil)
 
 	require.Equal(t, 25*time.Second, a.client.Timeout)
+	require.Equal(t, "http://localhost:8080", a.endpoint)
+}
+
+func TestSendData(t *testing.T) {
+	var received AgentObjectList
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer 123", r.Header.Get("Authorization"))
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&received))
+	}))
+	defer srv.Close()
+
+	exitCode := 137
+	a := New(&config.Backend{APIEndpoint: srv.URL, APIKey: "123"}, nil)
+	err := a.SendData(context.Background(), &data.Metrics{
+		Host: &data.Host{AgentID: "abc", Hostname: "node-1", DockerVersion: "24.0.5", Load1: 0.5, Timestamp: time.Date(2023, 2, 20, 10, 3, 0, 0, time.UTC)},
+		Container: []*data.ContainerMetrics{
+			{ID: "1", Name: "web", CPUUsage: 1.5, ComposeProject: "shop", Timestamp: time.Date(2023, 2, 20, 10, 3, 1, 0, time.UTC)},
+		},
+		Events: []*data.ContainerEvent{
+			{ID: "1", Name: "web", Action: "die", ExitCode: &exitCode},
+		},
+	})
+	require.Nil(t, err)
+
+	require.Equal(t, "abc", received.Host.AgentID)
+	require.Equal(t, "node-1", received.Host.Hostname)
+	require.Equal(t, "24.0.5", received.Host.DockerVersion)
+	require.Equal(t, 0.5, received.Host.Load1)
+	require.Equal(t, 1, len(received.Data))
+	require.Equal(t, "web", received.Data[0].Metadata.ContainerName)
+	require.Equal(t, "shop", received.Data[0].Metadata.ComposeProject)
+	require.Equal(t, 1.5, received.Data[0].Data.CPU)
+	require.Equal(t, time.Date(2023, 2, 20, 10, 3, 1, 0, time.UTC), received.Data[0].Timestamp)
+	require.Equal(t, time.Date(2023, 2, 20, 10, 3, 0, 0, time.UTC), received.Host.Timestamp)
+	require.Equal(t, 1, len(received.Events))
+	require.Equal(t, "die", received.Events[0].Action)
+	require.Equal(t, 137, *received.Events[0].ExitCode)
+}
+
+func TestSendDataError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("invalid api key"))
+	}))
+	defer srv.Close()
+
+	a := New(&config.Backend{APIEndpoint: srv.URL, APIKey: "123"}, nil)
+	err := a.SendData(context.Background(), &data.Metrics{})
+	require.EqualError(t, err, "response: invalid api key")
+}
+
+func TestCheck(t *testing.T) {
+	var received AgentObjectList
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer 123" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("invalid api key"))
+			return
+		}
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&received))
+	}))
+	defer srv.Close()
+
+	a := New(&config.Backend{APIEndpoint: srv.URL, APIKey: "123"}, nil)
+	require.Nil(t, a.Check(context.Background()))
+	require.Equal(t, 0, len(received.Data))
+
+	a = New(&config.Backend{APIEndpoint: srv.URL, APIKey: "wrong", MaxRetries: 3}, nil)
+	require.EqualError(t, a.Check(context.Background()), "api key was rejected: response: invalid api key")
 }
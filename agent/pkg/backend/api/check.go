@@ -0,0 +1,42 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/backend/httpsend"
+)
+
+// Check sends an empty payload to the endpoint once, without retrying, to
+// verify the endpoint resolves and accepts the API key
+func (a *api) Check(ctx context.Context) error {
+	u, err := url.Parse(a.endpoint)
+	if err != nil {
+		return err
+	}
+	_, err = net.DefaultResolver.LookupHost(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("could not resolve %s: %w", u.Hostname(), err)
+	}
+
+	jsonData, err := json.Marshal(&AgentObjectList{Data: []*AgentObject{}})
+	if err != nil {
+		return err
+	}
+	body, err := httpsend.Compress(a.config.Compression, jsonData)
+	if err != nil {
+		return err
+	}
+
+	err = a.post(ctx, body)
+	var se *statusError
+	if errors.As(err, &se) && (se.code == http.StatusUnauthorized || se.code == http.StatusForbidden) {
+		return fmt.Errorf("api key was rejected: %w", err)
+	}
+	return err
+}
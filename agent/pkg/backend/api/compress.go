@@ -0,0 +1,34 @@
+package api
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// acceptEncoding is sent with every request so the endpoint may compress its responses
+const acceptEncoding = "gzip, zstd"
+
+// readBody reads the response body, decoding it if the endpoint compressed it
+func readBody(res *http.Response) ([]byte, error) {
+	var r io.Reader = res.Body
+	switch res.Header.Get("Content-Encoding") {
+	case "gzip":
+		gr, err := gzip.NewReader(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		r = gr
+	case "zstd":
+		zr, err := zstd.NewReader(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	return io.ReadAll(r)
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/config"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+func decompress(t *testing.T, encoding string, body io.Reader) []byte {
+	switch encoding {
+	case "gzip":
+		r, err := gzip.NewReader(body)
+		require.Nil(t, err)
+		body = r
+	case "zstd":
+		r, err := zstd.NewReader(body)
+		require.Nil(t, err)
+		defer r.Close()
+		body = r
+	}
+	bts, err := io.ReadAll(body)
+	require.Nil(t, err)
+	return bts
+}
+
+func TestSendDataCompressed(t *testing.T) {
+	for _, encoding := range []string{"none", "gzip", "zstd"} {
+		var received AgentObjectList
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if encoding == "none" {
+				require.Equal(t, "", r.Header.Get("Content-Encoding"))
+			} else {
+				require.Equal(t, encoding, r.Header.Get("Content-Encoding"))
+			}
+			require.Equal(t, acceptEncoding, r.Header.Get("Accept-Encoding"))
+
+			bts := decompress(t, r.Header.Get("Content-Encoding"), r.Body)
+			require.Nil(t, json.Unmarshal(bts, &received))
+		}))
+
+		a := New(&config.Backend{APIEndpoint: srv.URL, APIKey: "123", Compression: encoding}, nil)
+		err := a.SendData(context.Background(), &data.Metrics{
+			Container: []*data.ContainerMetrics{{ID: "1"}},
+		})
+		srv.Close()
+
+		require.Nil(t, err)
+		require.Equal(t, "1", received.Data[0].Metadata.ContainerID)
+	}
+}
+
+func TestCompressedResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		gw.Write([]byte("invalid api key"))
+		gw.Close()
+
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write(buf.Bytes())
+	}))
+	defer srv.Close()
+
+	a := New(&config.Backend{APIEndpoint: srv.URL, APIKey: "123"}, nil)
+	err := a.SendData(context.Background(), &data.Metrics{})
+	require.EqualError(t, err, "response: invalid api key")
+}
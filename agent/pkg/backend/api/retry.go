@@ -0,0 +1,126 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// statusError is returned when the endpoint answers with a status other than 200
+type statusError struct {
+	code       int
+	body       string
+	retryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("response: %s", e.body)
+}
+
+// retryable returns true if a request that failed with err may succeed if retried
+// Transport errors, 429 and 5xx responses are retried, other 4xx responses such
+// as an invalid API key never are
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code == http.StatusTooManyRequests || se.code >= 500
+	}
+	return true
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// jitter returns a random duration between half of d and d
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)))
+}
+
+// sendWithRetry posts the body, retrying with exponential backoff and jitter
+// Retries stop once the configured number of retries is reached or the next
+// attempt would start after the retry budget is used up. The budget also
+// bounds the attempts themselves, so an endpoint that never answers can not
+// hold up the poll for the whole client timeout
+func (a *api) sendWithRetry(parent context.Context, body []byte) error {
+	maxRetries := a.config.MaxRetries
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+	backoff := time.Duration(a.config.RetryBackoff) * time.Millisecond
+	maxBackoff := time.Duration(a.config.RetryMaxBackoff) * time.Millisecond
+
+	ctx := parent
+	var deadline time.Time
+	if a.config.RetryBudget > 0 {
+		budget := time.Duration(a.config.RetryBudget) * time.Second
+		deadline = a.now().Add(budget)
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(parent, budget)
+		defer cancel()
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := a.post(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil && parent.Err() == nil {
+			return fmt.Errorf("retry budget used up: %w", err)
+		}
+		if !retryable(ctx, err) || attempt > maxRetries {
+			if attempt == 1 {
+				return err
+			}
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+
+		wait := jitter(backoff)
+		var se *statusError
+		if errors.As(err, &se) && se.retryAfter > 0 {
+			wait = se.retryAfter
+		}
+		if !deadline.IsZero() && a.now().Add(wait).After(deadline) {
+			return fmt.Errorf("retry budget used up: %w", err)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("canceled while waiting to retry: %w", err)
+		case <-timer.C:
+		}
+
+		backoff *= 2
+		if maxBackoff > 0 && backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/config"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+	"github.com/stretchr/testify/require"
+)
+
+// newFlakyServer answers with the given status codes in order and 200 afterwards
+func newFlakyServer(codes ...int) (*httptest.Server, *int32) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		if int(n) <= len(codes) {
+			w.WriteHeader(codes[n-1])
+		}
+	}))
+	return srv, &calls
+}
+
+func newRetryBackend(endpoint string) *config.Backend {
+	return &config.Backend{
+		APIEndpoint:     endpoint,
+		APIKey:          "123",
+		MaxRetries:      3,
+		RetryBackoff:    1,
+		RetryMaxBackoff: 5,
+		RetryBudget:     10,
+	}
+}
+
+func TestRetry(t *testing.T) {
+	srv, calls := newFlakyServer(http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	defer srv.Close()
+
+	a := New(newRetryBackend(srv.URL), nil)
+	err := a.SendData(context.Background(), &data.Metrics{})
+	require.Nil(t, err)
+	require.Equal(t, int32(3), *calls)
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	srv, calls := newFlakyServer(500, 500, 500, 500, 500)
+	defer srv.Close()
+
+	a := New(newRetryBackend(srv.URL), nil)
+	err := a.SendData(context.Background(), &data.Metrics{})
+	require.EqualError(t, err, "giving up after 4 attempts: response: ")
+	require.Equal(t, int32(4), *calls)
+}
+
+func TestRetryNotOnAuthError(t *testing.T) {
+	srv, calls := newFlakyServer(http.StatusUnauthorized)
+	defer srv.Close()
+
+	a := New(newRetryBackend(srv.URL), nil)
+	err := a.SendData(context.Background(), &data.Metrics{})
+	require.EqualError(t, err, "response: ")
+	require.Equal(t, int32(1), *calls)
+}
+
+func TestRetryDisabled(t *testing.T) {
+	srv, calls := newFlakyServer(http.StatusBadGateway)
+	defer srv.Close()
+
+	c := newRetryBackend(srv.URL)
+	c.MaxRetries = -1
+	a := New(c, nil)
+	err := a.SendData(context.Background(), &data.Metrics{})
+	require.EqualError(t, err, "response: ")
+	require.Equal(t, int32(1), *calls)
+}
+
+func TestRetryTransportError(t *testing.T) {
+	srv, _ := newFlakyServer()
+	srv.Close()
+
+	a := New(newRetryBackend(srv.URL), nil)
+	err := a.SendData(context.Background(), &data.Metrics{})
+	require.Contains(t, err.Error(), "giving up after 4 attempts")
+}
+
+func TestRetryAfterBudget(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	// Waiting 60 seconds would overrun the 10 second budget, so give up at once
+	a := New(newRetryBackend(srv.URL), nil)
+	start := time.Now()
+	err := a.SendData(context.Background(), &data.Metrics{})
+	require.EqualError(t, err, "retry budget used up: response: ")
+	require.Equal(t, int32(1), calls)
+	require.True(t, time.Since(start) < time.Second)
+}
+
+func TestRetryBudgetBoundsAttempt(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	// The endpoint never answers, the attempt is given up on once the
+	// budget is used up instead of after the client timeout
+	c := newRetryBackend(srv.URL)
+	c.RetryBudget = 1
+	a := New(c, nil)
+	start := time.Now()
+	err := a.SendData(context.Background(), &data.Metrics{})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "retry budget used up")
+	require.True(t, time.Since(start) < 2*time.Second)
+}
+
+func TestRetryCanceled(t *testing.T) {
+	srv, _ := newFlakyServer(500, 500, 500, 500)
+	defer srv.Close()
+
+	c := newRetryBackend(srv.URL)
+	c.RetryBackoff = 60000
+	c.RetryMaxBackoff = 60000
+	c.RetryBudget = 0
+	a := New(c, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := a.SendData(ctx, &data.Metrics{})
+	require.EqualError(t, err, "canceled while waiting to retry: response: ")
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 2, 20, 10, 0, 0, 0, time.UTC)
+
+	require.Equal(t, 5*time.Second, parseRetryAfter("5", now))
+	require.Equal(t, time.Duration(0), parseRetryAfter("", now))
+	require.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+	require.Equal(t, 30*time.Second, parseRetryAfter("Mon, 20 Feb 2023 10:00:30 GMT", now))
+	require.Equal(t, time.Duration(0), parseRetryAfter("Mon, 20 Feb 2023 09:00:00 GMT", now))
+}
+
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		d := jitter(time.Second)
+		require.True(t, d >= 500*time.Millisecond && d < time.Second)
+	}
+}
@@ -1,9 +1,33 @@
 package backend
 
 import (
+	"context"
+
 	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
 )
 
 type Backend interface {
-	SendData(metrics *data.Metrics) error
+	SendData(ctx context.Context, metrics *data.Metrics) error
+}
+
+// Closer is implemented by backends that buffer data or hold resources
+// Close sends what is still buffered until ctx is done and then releases
+// the resources
+type Closer interface {
+	Close(ctx context.Context) error
+}
+
+// Spooler is implemented by backends that can keep metrics on disk to send
+// them later, e.g. when they can not keep up
+type Spooler interface {
+	Spool(metrics *data.Metrics) error
+}
+
+// Close closes the backend if it implements Closer
+func Close(ctx context.Context, b Backend) error {
+	closer, ok := b.(Closer)
+	if !ok {
+		return nil
+	}
+	return closer.Close(ctx)
 }
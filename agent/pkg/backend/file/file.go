@@ -0,0 +1,258 @@
+package file
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/config"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+)
+
+// rotatedFormat is the time format appended to the names of rotated files
+// It sorts in the order the files were rotated in
+const rotatedFormat = "20060102T150405.000000000Z"
+
+// record is a single line of the file
+type record struct {
+	// Timestamp is the time the metrics were collected, or written if they
+	// carry no time
+	Timestamp time.Time `json:"timestamp"`
+
+	// Host is the name of the host the metrics were collected on
+	Host string `json:"host"`
+
+	Metrics *data.Metrics `json:"metrics"`
+}
+
+// file appends the metrics as JSON lines to a file and rotates it once it
+// grows past its size or age limit
+type file struct {
+	path      string
+	maxSize   int64
+	maxAge    time.Duration
+	compress  bool
+	retention int
+
+	mu       sync.Mutex
+	fd       *os.File
+	size     int64
+	created  time.Time
+	hostname string
+	now      func() time.Time
+}
+
+func New(config *config.Backend) (*file, error) {
+	hostname, _ := os.Hostname()
+	f := &file{
+		path:      config.FilePath,
+		maxSize:   int64(config.FileMaxSize) * 1024 * 1024,
+		maxAge:    time.Duration(config.FileMaxAge) * time.Second,
+		compress:  config.FileCompress,
+		retention: config.FileRetention,
+		hostname:  hostname,
+		now:       time.Now,
+	}
+
+	err := os.MkdirAll(filepath.Dir(f.path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = f.open()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *file) SendData(_ context.Context, metrics *data.Metrics) error {
+	now := f.now()
+	host := f.hostname
+	if metrics.Host != nil && metrics.Host.Hostname != "" {
+		host = metrics.Host.Hostname
+	}
+
+	// A poll without host or containers has no time of its own
+	timestamp := metrics.Collected()
+	if timestamp.IsZero() {
+		timestamp = now
+	}
+
+	bts, err := json.Marshal(record{
+		Timestamp: timestamp,
+		Host:      host,
+		Metrics:   metrics,
+	})
+	if err != nil {
+		return err
+	}
+	bts = append(bts, '\n')
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.fd == nil {
+		err = f.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	// An empty file is never rotated so a single large line still gets written
+	if f.size > 0 && (f.size+int64(len(bts)) > f.maxSize || now.Sub(f.created) > f.maxAge) {
+		err = f.rotate(now)
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := f.fd.Write(bts)
+	f.size += int64(n)
+	return err
+}
+
+// Close closes the file, it is reopened if more metrics are sent
+func (f *file) Close(_ context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.fd == nil {
+		return nil
+	}
+	err := f.fd.Close()
+	f.fd = nil
+	return err
+}
+
+// open opens the file for appending
+// The age of a file that already has data is counted from its last write,
+// as the time it was created is not known
+func (f *file) open() error {
+	fd, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return err
+	}
+
+	f.fd = fd
+	f.size = info.Size()
+	f.created = f.now()
+	if f.size > 0 {
+		f.created = info.ModTime()
+	}
+	return nil
+}
+
+// rotate renames the file, compresses it if enabled, removes the rotated
+// files past the retention count and opens a new file
+func (f *file) rotate(now time.Time) error {
+	err := f.fd.Close()
+	f.fd = nil
+	if err != nil {
+		return err
+	}
+
+	rotated := f.path + "." + now.UTC().Format(rotatedFormat)
+	err = os.Rename(f.path, rotated)
+	if err != nil {
+		return err
+	}
+
+	if f.compress {
+		err = compress(rotated)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = f.enforceRetention()
+	if err != nil {
+		return err
+	}
+
+	return f.open()
+}
+
+// enforceRetention removes the oldest rotated files until at most retention
+// are left, a negative retention keeps all of them
+func (f *file) enforceRetention() error {
+	if f.retention < 0 {
+		return nil
+	}
+
+	dir, base := filepath.Split(f.path)
+	entries, err := os.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return err
+	}
+
+	var rotated []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, base+".") || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		_, err := time.Parse(rotatedFormat, strings.TrimSuffix(strings.TrimPrefix(name, base+"."), ".gz"))
+		if err != nil {
+			continue
+		}
+		rotated = append(rotated, name)
+	}
+	sort.Strings(rotated)
+
+	for len(rotated) > f.retention {
+		err = os.Remove(filepath.Join(dir, rotated[0]))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+// compress gzips the file at path to path.gz and removes the original
+func compress(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := gzip.NewWriter(dst)
+	_, err = io.Copy(w, src)
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = dst.Close()
+	} else {
+		dst.Close()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, path+".gz")
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,152 @@
+package file
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/config"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestFile(t *testing.T, c *config.Backend) (*file, *time.Time) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	f, err := New(c)
+	require.Nil(t, err)
+	f.now = func() time.Time { return now }
+	f.created = now
+	t.Cleanup(func() { f.Close(context.Background()) })
+	return f, &now
+}
+
+func testMetrics() *data.Metrics {
+	return &data.Metrics{
+		Host:      &data.Host{Hostname: "docker-1"},
+		Container: []*data.ContainerMetrics{{ID: "1", Name: "web", State: "running"}},
+	}
+}
+
+// rotatedFiles returns the names of the rotated files in dir
+func rotatedFiles(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	require.Nil(t, err)
+
+	var ret []string
+	for _, entry := range entries {
+		if entry.Name() != "metrics.jsonl" {
+			ret = append(ret, entry.Name())
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func TestSendData(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "metrics.jsonl")
+	f, now := newTestFile(t, &config.Backend{FilePath: path, FileMaxSize: 100, FileMaxAge: 3600, FileRetention: 7})
+
+	require.Nil(t, f.SendData(context.Background(), testMetrics()))
+	require.Nil(t, f.SendData(context.Background(), &data.Metrics{}))
+
+	fd, err := os.Open(path)
+	require.Nil(t, err)
+	defer fd.Close()
+
+	var records []record
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		var r record
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), &r))
+		records = append(records, r)
+	}
+	require.Len(t, records, 2)
+	require.True(t, now.Equal(records[0].Timestamp))
+	require.Equal(t, "docker-1", records[0].Host)
+	require.Equal(t, "web", records[0].Metrics.Container[0].Name)
+
+	// Without host metrics the hostname of the machine is used
+	hostname, _ := os.Hostname()
+	require.Equal(t, hostname, records[1].Host)
+}
+
+func TestRotateBySize(t *testing.T) {
+	dir := t.TempDir()
+	f, now := newTestFile(t, &config.Backend{FilePath: filepath.Join(dir, "metrics.jsonl"), FileMaxAge: 3600, FileRetention: 2})
+	f.maxSize = 100
+
+	for i := 0; i < 5; i++ {
+		*now = now.Add(time.Second)
+		require.Nil(t, f.SendData(context.Background(), testMetrics()))
+	}
+
+	// Every line is larger than the limit, so every write but the first
+	// rotates and only the two newest rotated files are kept
+	require.Equal(t, []string{
+		"metrics.jsonl.20230101T000004.000000000Z",
+		"metrics.jsonl.20230101T000005.000000000Z",
+	}, rotatedFiles(t, dir))
+}
+
+func TestRotateByAge(t *testing.T) {
+	dir := t.TempDir()
+	f, now := newTestFile(t, &config.Backend{FilePath: filepath.Join(dir, "metrics.jsonl"), FileMaxSize: 100, FileMaxAge: 60, FileRetention: -1})
+
+	require.Nil(t, f.SendData(context.Background(), testMetrics()))
+	*now = now.Add(30 * time.Second)
+	require.Nil(t, f.SendData(context.Background(), testMetrics()))
+	require.Empty(t, rotatedFiles(t, dir))
+
+	*now = now.Add(31 * time.Second)
+	require.Nil(t, f.SendData(context.Background(), testMetrics()))
+	require.Equal(t, []string{"metrics.jsonl.20230101T000101.000000000Z"}, rotatedFiles(t, dir))
+}
+
+func TestRotateCompress(t *testing.T) {
+	dir := t.TempDir()
+	f, now := newTestFile(t, &config.Backend{FilePath: filepath.Join(dir, "metrics.jsonl"), FileMaxSize: 100, FileMaxAge: 60, FileCompress: true, FileRetention: 7})
+
+	require.Nil(t, f.SendData(context.Background(), testMetrics()))
+	*now = now.Add(time.Hour)
+	require.Nil(t, f.SendData(context.Background(), testMetrics()))
+
+	rotated := rotatedFiles(t, dir)
+	require.Equal(t, []string{"metrics.jsonl.20230101T010000.000000000Z.gz"}, rotated)
+
+	fd, err := os.Open(filepath.Join(dir, rotated[0]))
+	require.Nil(t, err)
+	defer fd.Close()
+	r, err := gzip.NewReader(fd)
+	require.Nil(t, err)
+
+	var rec record
+	require.Nil(t, json.NewDecoder(r).Decode(&rec))
+	require.Equal(t, "docker-1", rec.Host)
+
+	// Compressed files count towards the retention and unrelated files are kept
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "metrics.jsonl.bak"), nil, 0644))
+	f.retention = 0
+	*now = now.Add(time.Hour)
+	require.Nil(t, f.SendData(context.Background(), testMetrics()))
+	require.Equal(t, []string{"metrics.jsonl.bak"}, rotatedFiles(t, dir))
+}
+
+func TestReopenAfterClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.jsonl")
+	f, _ := newTestFile(t, &config.Backend{FilePath: path, FileMaxSize: 100, FileMaxAge: 60, FileRetention: 7})
+
+	require.Nil(t, f.SendData(context.Background(), testMetrics()))
+	require.Nil(t, f.Close(context.Background()))
+	require.Nil(t, f.SendData(context.Background(), testMetrics()))
+
+	bts, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, 2, strings.Count(string(bts), "\n"))
+}
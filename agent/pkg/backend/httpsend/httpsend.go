@@ -0,0 +1,93 @@
+package httpsend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxErrorBody is how much of a failed response is read into the error
+const maxErrorBody = 4096
+
+// Client returns client, or a client with the default timeout if it is nil
+func Client(client *http.Client) *http.Client {
+	if client != nil {
+		return client
+	}
+	return &http.Client{
+		Timeout: 25 * time.Second,
+	}
+}
+
+// Compress encodes the body with the given content encoding
+// An empty encoding or "none" returns the body as is
+func Compress(encoding string, body []byte) ([]byte, error) {
+	switch encoding {
+	case "", "none":
+		return body, nil
+	case "gzip":
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, err := w.Write(body)
+		if err != nil {
+			return nil, err
+		}
+		err = w.Close()
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "zstd":
+		w, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer w.Close()
+		return w.EncodeAll(body, nil), nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", encoding)
+	}
+}
+
+// NewRequest creates a POST request with the body compressed with the given
+// encoding and its Content-Encoding set to match
+func NewRequest(ctx context.Context, url, encoding string, body []byte) (*http.Request, error) {
+	body, err := Compress(encoding, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if encoding != "" && encoding != "none" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	return req, nil
+}
+
+// Do sends the request and fails unless the response has a 2xx status
+// The error names the peer and holds the start of the response body
+func Do(client *http.Client, req *http.Request, peer string) error {
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	msg, err := io.ReadAll(io.LimitReader(res.Body, maxErrorBody))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s responded with %s: %s", peer, res.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package httpsend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient(t *testing.T) {
+	client := &http.Client{}
+	require.Same(t, client, Client(client))
+	require.NotNil(t, Client(nil))
+	require.NotZero(t, Client(nil).Timeout)
+}
+
+func TestCompressUnknown(t *testing.T) {
+	_, err := Compress("br", []byte("{}"))
+	require.EqualError(t, err, `unknown compression "br"`)
+}
+
+func TestNewRequest(t *testing.T) {
+	req, err := NewRequest(context.Background(), "http://localhost", "none", []byte("data"))
+	require.Nil(t, err)
+	require.Equal(t, "POST", req.Method)
+	require.Equal(t, "", req.Header.Get("Content-Encoding"))
+
+	req, err = NewRequest(context.Background(), "http://localhost", "gzip", []byte("data"))
+	require.Nil(t, err)
+	require.Equal(t, "gzip", req.Header.Get("Content-Encoding"))
+	r, err := gzip.NewReader(req.Body)
+	require.Nil(t, err)
+	bts, err := io.ReadAll(r)
+	require.Nil(t, err)
+	require.Equal(t, "data", string(bts))
+}
+
+func TestDo(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ok" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		http.Error(w, strings.Repeat("x", 2*maxErrorBody), http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	req, err := http.NewRequest("POST", srv.URL+"/ok", bytes.NewReader(nil))
+	require.Nil(t, err)
+	require.Nil(t, Do(srv.Client(), req, "collector"))
+
+	req, err = http.NewRequest("POST", srv.URL, bytes.NewReader(nil))
+	require.Nil(t, err)
+	err = Do(srv.Client(), req, "collector")
+	require.EqualError(t, err, "collector responded with 400 Bad Request: "+strings.Repeat("x", maxErrorBody))
+}
@@ -0,0 +1,115 @@
+package influxdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/backend/httpsend"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/config"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+)
+
+// maxDatagramSize is the largest UDP payload sent, lines are packed into
+// datagrams up to that size so they are not fragmented on common networks
+const maxDatagramSize = 1400
+
+type influxdb struct {
+	config *config.Backend
+	client *http.Client
+}
+
+func New(config *config.Backend, client *http.Client) *influxdb {
+	return &influxdb{
+		config: config,
+		client: httpsend.Client(client),
+	}
+}
+
+func (i *influxdb) SendData(ctx context.Context, metrics *data.Metrics) error {
+	lines := encode(metrics)
+	if len(lines) == 0 {
+		return nil
+	}
+
+	u, err := url.Parse(i.config.InfluxURL)
+	if err != nil {
+		return err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return i.write(ctx, u, bytes.Join(lines, nil))
+	case "udp":
+		return i.sendUDP(ctx, u.Host, lines)
+	case "file":
+		return i.appendFile(u.Path, bytes.Join(lines, nil))
+	default:
+		return fmt.Errorf("unsupported influx url scheme %q", u.Scheme)
+	}
+}
+
+// write sends the lines to the InfluxDB v2 write API
+func (i *influxdb) write(ctx context.Context, u *url.URL, body []byte) error {
+	u = u.JoinPath("/api/v2/write")
+	q := u.Query()
+	q.Set("org", i.config.InfluxOrg)
+	q.Set("bucket", i.config.InfluxBucket)
+	q.Set("precision", "ns")
+	u.RawQuery = q.Encode()
+
+	req, err := httpsend.NewRequest(ctx, u.String(), i.config.Compression, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if i.config.InfluxToken != "" {
+		req.Header.Set("Authorization", "Token "+i.config.InfluxToken)
+	}
+
+	return httpsend.Do(i.client, req, "influxdb")
+}
+
+// sendUDP sends the lines to a UDP listener such as Telegraf's socket_listener
+// Lines are packed into as few datagrams as possible, a line is never split
+func (i *influxdb) sendUDP(ctx context.Context, address string, lines [][]byte) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var datagram []byte
+	for _, line := range lines {
+		if len(datagram) > 0 && len(datagram)+len(line) > maxDatagramSize {
+			_, err = conn.Write(datagram)
+			if err != nil {
+				return err
+			}
+			datagram = datagram[:0]
+		}
+		datagram = append(datagram, line...)
+	}
+	_, err = conn.Write(datagram)
+	return err
+}
+
+// appendFile appends the lines to a file, e.g. for Telegraf's tail input
+func (i *influxdb) appendFile(path string, body []byte) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(body)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,141 @@
+package influxdb
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/config"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+	"github.com/stretchr/testify/require"
+)
+
+var timestamp = time.Unix(1700000000, 0)
+
+func testMetrics() *data.Metrics {
+	exitCode := 137
+	return &data.Metrics{
+		Host: &data.Host{Hostname: "docker-1", CPUs: 4, Timestamp: timestamp},
+		Container: []*data.ContainerMetrics{
+			{
+				ID:             "1",
+				Name:           "web server",
+				Timestamp:      timestamp,
+				Image:          "nginx",
+				State:          "running",
+				HealthStatus:   "healthy",
+				CPUUsage:       1.5,
+				MemoryUsage:    1024,
+				NetworkIORead:  100,
+				NetworkIOWrite: 200,
+			},
+			{ID: "2", Name: "db", Image: "postgres", State: "exited", ExitCode: &exitCode, RestartCount: 2, Timestamp: timestamp.Add(time.Second)},
+		},
+	}
+}
+
+func newTestBackend(c *config.Backend) *influxdb {
+	i := New(c, nil)
+	return i
+}
+
+func TestEncode(t *testing.T) {
+	lines := encode(testMetrics())
+	require.Len(t, lines, 3)
+
+	require.True(t, strings.HasPrefix(string(lines[0]), "dockwizard_host,host=docker-1 cpus=4i,cpu_usage=0,"))
+	require.Equal(t, "dockwizard_container,container_id=1,container_name=web\\ server,host=docker-1,image=nginx,state=running "+
+		"cpu_usage=1.5,cpu_user_percentage=0,cpu_system_percentage=0,cpu_limit=0,cpu_periods=0i,cpu_throttled_periods=0i,"+
+		"cpu_throttled_time=0i,cpu_throttled_percentage=0,pids=0i,pids_limit=0i,memory_usage=1024i,memory_usage_percentage=0,"+
+		"network_io_read=100i,network_io_write=200i,block_io_read=0i,block_io_write=0i,health_status=\"healthy\" 1700000000000000000\n", string(lines[1]))
+	require.Equal(t, "dockwizard_container,container_id=2,container_name=db,host=docker-1,image=postgres,state=exited "+
+		"exit_code=137i,restart_count=2i 1700000001000000000\n", string(lines[2]))
+}
+
+func TestAppendLineEscaping(t *testing.T) {
+	line := appendLine(nil, "a b,c", map[string]string{"k=1": "v,1 2", "empty": ""}, []field{
+		{key: "s", value: `"` + stringEscaper.Replace(`say "hi" \o/`) + `"`},
+	}, 1)
+	require.Equal(t, `a\ b\,c,k\=1=v\,1\ 2 s="say \"hi\" \\o/" 1`+"\n", string(line))
+}
+
+func TestSendDataHTTP(t *testing.T) {
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v2/write", r.URL.Path)
+		require.Equal(t, "example", r.URL.Query().Get("org"))
+		require.Equal(t, "docker", r.URL.Query().Get("bucket"))
+		require.Equal(t, "ns", r.URL.Query().Get("precision"))
+		require.Equal(t, "Token 123", r.Header.Get("Authorization"))
+
+		bts, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+		body = string(bts)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	i := newTestBackend(&config.Backend{InfluxURL: srv.URL, InfluxOrg: "example", InfluxBucket: "docker", InfluxToken: "123"})
+	err := i.SendData(context.Background(), testMetrics())
+	require.Nil(t, err)
+	require.Equal(t, 3, strings.Count(body, "\n"))
+}
+
+func TestSendDataHTTPError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"code":"unauthorized"}`, http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	i := newTestBackend(&config.Backend{InfluxURL: srv.URL, InfluxOrg: "example", InfluxBucket: "docker"})
+	err := i.SendData(context.Background(), testMetrics())
+	require.EqualError(t, err, `influxdb responded with 401 Unauthorized: {"code":"unauthorized"}`)
+}
+
+func TestSendDataUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer conn.Close()
+
+	// Enough containers to need more than one datagram
+	metrics := testMetrics()
+	for n := 0; n < 20; n++ {
+		metrics.Container = append(metrics.Container, metrics.Container[0])
+	}
+
+	i := newTestBackend(&config.Backend{InfluxURL: "udp://" + conn.LocalAddr().String()})
+	err = i.SendData(context.Background(), metrics)
+	require.Nil(t, err)
+
+	expected := len(encode(metrics))
+	var received int
+	buf := make([]byte, 65536)
+	for received < expected {
+		require.Nil(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		n, _, err := conn.ReadFrom(buf)
+		require.Nil(t, err)
+		require.LessOrEqual(t, n, maxDatagramSize)
+		require.True(t, strings.HasSuffix(string(buf[:n]), "\n"))
+		received += strings.Count(string(buf[:n]), "\n")
+	}
+	require.Equal(t, expected, received)
+}
+
+func TestSendDataFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.lp")
+	i := newTestBackend(&config.Backend{InfluxURL: "file://" + path})
+
+	require.Nil(t, i.SendData(context.Background(), testMetrics()))
+	require.Nil(t, i.SendData(context.Background(), testMetrics()))
+
+	bts, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, 6, strings.Count(string(bts), "\n"))
+}
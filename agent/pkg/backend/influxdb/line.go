@@ -0,0 +1,159 @@
+package influxdb
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+)
+
+const (
+	containerMeasurement = "dockwizard_container"
+	hostMeasurement      = "dockwizard_host"
+)
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	tagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	stringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// field is a single field of a line, value is already formatted
+type field struct {
+	key   string
+	value string
+}
+
+func floatField(key string, v float64) field {
+	return field{key: key, value: strconv.FormatFloat(v, 'f', -1, 64)}
+}
+
+func intField(key string, v int) field {
+	return field{key: key, value: strconv.Itoa(v) + "i"}
+}
+
+// appendLine appends a line in line protocol to b
+// Tags with an empty value are left out as line protocol does not allow them
+// and tags are sorted by key as recommended for write performance
+func appendLine(b []byte, measurement string, tags map[string]string, fields []field, timestamp int64) []byte {
+	b = append(b, measurementEscaper.Replace(measurement)...)
+
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b = append(b, ',')
+		b = append(b, tagEscaper.Replace(k)...)
+		b = append(b, '=')
+		b = append(b, tagEscaper.Replace(tags[k])...)
+	}
+
+	for i, f := range fields {
+		if i == 0 {
+			b = append(b, ' ')
+		} else {
+			b = append(b, ',')
+		}
+		b = append(b, tagEscaper.Replace(f.key)...)
+		b = append(b, '=')
+		b = append(b, f.value...)
+	}
+
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, timestamp, 10)
+	return append(b, '\n')
+}
+
+// encode returns the lines for the host and the containers, each with the
+// time it was collected at
+func encode(metrics *data.Metrics) [][]byte {
+	var lines [][]byte
+
+	var hostname string
+	if h := metrics.Host; h != nil {
+		hostname = h.Hostname
+		lines = append(lines, appendLine(nil, hostMeasurement, map[string]string{
+			"host":     h.Hostname,
+			"agent_id": h.AgentID,
+		}, hostFields(h), h.Timestamp.UnixNano()))
+	}
+
+	for _, c := range metrics.Container {
+		fields := containerFields(c)
+		// Line protocol requires at least one field
+		if len(fields) == 0 {
+			continue
+		}
+
+		tags := map[string]string{
+			"container_id":    c.ID,
+			"container_name":  c.Name,
+			"image":           c.Image,
+			"state":           c.State,
+			"host":            hostname,
+			"compose_project": c.ComposeProject,
+			"compose_service": c.ComposeService,
+		}
+		lines = append(lines, appendLine(nil, containerMeasurement, tags, fields, c.Timestamp.UnixNano()))
+	}
+
+	return lines
+}
+
+func hostFields(h *data.Host) []field {
+	return []field{
+		intField("cpus", h.CPUs),
+		floatField("cpu_usage", h.CPUUsage),
+		intField("memory_total", h.MemoryTotal),
+		intField("memory_usage", h.MemoryUsage),
+		floatField("memory_usage_percentage", h.MemoryUsagePercentage),
+		floatField("load1", h.Load1),
+		floatField("load5", h.Load5),
+		floatField("load15", h.Load15),
+		intField("disk_total", h.DiskTotal),
+		intField("disk_usage", h.DiskUsage),
+		floatField("disk_usage_percentage", h.DiskUsagePercentage),
+	}
+}
+
+// containerFields returns the fields of the container
+// The usage fields are only written for containers that have stats so a
+// stopped container does not show up as using nothing
+func containerFields(c *data.ContainerMetrics) []field {
+	var fields []field
+	if c.HasStats() {
+		fields = append(fields,
+			floatField("cpu_usage", c.CPUUsage),
+			floatField("cpu_user_percentage", c.CPUUserPercentage),
+			floatField("cpu_system_percentage", c.CPUSystemPercentage),
+			floatField("cpu_limit", c.CPULimit),
+			intField("cpu_periods", c.CPUPeriods),
+			intField("cpu_throttled_periods", c.CPUThrottledPeriods),
+			intField("cpu_throttled_time", c.CPUThrottledTime),
+			floatField("cpu_throttled_percentage", c.CPUThrottledPercentage),
+			intField("pids", c.PIDs),
+			intField("pids_limit", c.PIDsLimit),
+			intField("memory_usage", c.MemoryUsage),
+			floatField("memory_usage_percentage", c.MemoryUsagePercentage),
+			intField("network_io_read", c.NetworkIORead),
+			intField("network_io_write", c.NetworkIOWrite),
+			intField("block_io_read", c.BlockIORead),
+			intField("block_io_write", c.BlockIOWrite),
+		)
+	}
+	if c.HealthStatus != "" {
+		fields = append(fields, field{key: "health_status", value: `"` + stringEscaper.Replace(c.HealthStatus) + `"`})
+	}
+	if c.ExitCode != nil {
+		fields = append(fields, intField("exit_code", *c.ExitCode))
+	}
+	if !c.Running() {
+		fields = append(fields, intField("restart_count", c.RestartCount))
+	}
+	return fields
+}
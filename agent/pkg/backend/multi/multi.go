@@ -0,0 +1,156 @@
+package multi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/backend"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultQueueSize is the number of polls queued per backend before
+// new polls are spooled or, for backends without a spool, dropped for that
+// backend
+const DefaultQueueSize = 16
+
+// Named is a backend with the name it is reported under
+type Named struct {
+	Name    string
+	Backend backend.Backend
+}
+
+type worker struct {
+	name    string
+	backend backend.Backend
+	queue   chan *data.Metrics
+}
+
+type multi struct {
+	workers []*worker
+	wg      sync.WaitGroup
+
+	// ctx is passed to the backends and canceled once Close gives up
+	// waiting for the queues to drain
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// New returns a backend that sends every poll to all backends
+// Every backend is sent to from its own goroutine and queue, so a slow or
+// failing backend does not hold up the others
+func New(backends []Named, queueSize int) *multi {
+	if queueSize < 1 {
+		queueSize = DefaultQueueSize
+	}
+
+	m := &multi{}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	for _, b := range backends {
+		w := &worker{
+			name:    b.Name,
+			backend: b.Backend,
+			queue:   make(chan *data.Metrics, queueSize),
+		}
+		m.workers = append(m.workers, w)
+
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			w.run(m.ctx)
+		}()
+	}
+
+	return m
+}
+
+func (w *worker) run(ctx context.Context) {
+	for metrics := range w.queue {
+		err := w.backend.SendData(ctx, metrics)
+		if err != nil {
+			logrus.Errorf("could not send metrics to backend %s: %v", w.name, err)
+		}
+	}
+}
+
+// SendData queues the metrics for every backend
+// Backends whose queue is full spool the metrics if they can, which may
+// send them ahead of the queued ones. The returned error lists the backends
+// the metrics were dropped for
+func (m *multi) SendData(_ context.Context, metrics *data.Metrics) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closed {
+		return fmt.Errorf("backend is closed")
+	}
+
+	var full []string
+	for _, w := range m.workers {
+		select {
+		case w.queue <- metrics:
+		default:
+			spooler, ok := w.backend.(backend.Spooler)
+			if !ok {
+				full = append(full, w.name)
+				continue
+			}
+			err := spooler.Spool(metrics)
+			if err != nil {
+				full = append(full, fmt.Sprintf("%s (%v)", w.name, err))
+			}
+		}
+	}
+
+	if len(full) > 0 {
+		return fmt.Errorf("queue full, dropped metrics for backends: %s", strings.Join(full, ", "))
+	}
+	return nil
+}
+
+// Close waits until the queued metrics are sent or ctx is done, in which case
+// the sends in flight are canceled. It then closes the backends
+func (m *multi) Close(ctx context.Context) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	for _, w := range m.workers {
+		close(w.queue)
+	}
+	m.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		m.cancel()
+		<-done
+	}
+	m.cancel()
+
+	var errs []string
+	for _, w := range m.workers {
+		err := backend.Close(ctx, w.backend)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", w.name, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to close backends: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
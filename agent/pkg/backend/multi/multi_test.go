@@ -0,0 +1,132 @@
+package multi
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/spool"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeBackend struct {
+	mu    sync.Mutex
+	err   error
+	block chan struct{}
+	sent  []*data.Metrics
+}
+
+func (f *fakeBackend) SendData(_ context.Context, metrics *data.Metrics) error {
+	if f.block != nil {
+		<-f.block
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	f.sent = append(f.sent, metrics)
+	return nil
+}
+
+func TestSendData(t *testing.T) {
+	a := &fakeBackend{}
+	b := &fakeBackend{err: fmt.Errorf("unreachable")}
+	m := New([]Named{{Name: "a", Backend: a}, {Name: "b", Backend: b}}, 0)
+
+	for i := 0; i < 3; i++ {
+		require.Nil(t, m.SendData(context.Background(), &data.Metrics{}))
+	}
+	require.Nil(t, m.Close(context.Background()))
+
+	require.Equal(t, 3, len(a.sent))
+	require.Equal(t, 0, len(b.sent))
+}
+
+func TestSendDataSlowBackend(t *testing.T) {
+	fast := &fakeBackend{}
+	slow := &fakeBackend{block: make(chan struct{})}
+	m := New([]Named{{Name: "fast", Backend: fast}, {Name: "slow", Backend: slow}}, 1)
+
+	// The slow backend takes the first poll and queues the second,
+	// the third is dropped for it but not for the fast backend
+	drained := func() bool {
+		return len(m.workers[0].queue) == 0 && len(m.workers[1].queue) == 0
+	}
+	require.Nil(t, m.SendData(context.Background(), &data.Metrics{}))
+	require.Eventually(t, drained, time.Second, time.Millisecond)
+	require.Nil(t, m.SendData(context.Background(), &data.Metrics{}))
+	require.Eventually(t, func() bool { return len(m.workers[0].queue) == 0 }, time.Second, time.Millisecond)
+	require.EqualError(t, m.SendData(context.Background(), &data.Metrics{}), "queue full, dropped metrics for backends: slow")
+
+	close(slow.block)
+	require.Nil(t, m.Close(context.Background()))
+	require.Equal(t, 3, len(fast.sent))
+	require.Equal(t, 2, len(slow.sent))
+}
+
+func TestSendDataSlowSpooledBackend(t *testing.T) {
+	s, err := spool.New(t.TempDir(), 0, 0)
+	require.Nil(t, err)
+	slow := &fakeBackend{block: make(chan struct{})}
+	m := New([]Named{{Name: "slow", Backend: s.Wrap(slow)}}, 1)
+
+	// Once the queue is full the polls go to the spool instead of being
+	// dropped
+	require.Nil(t, m.SendData(context.Background(), &data.Metrics{}))
+	require.Eventually(t, func() bool { return len(m.workers[0].queue) == 0 }, time.Second, time.Millisecond)
+	for i := 0; i < 3; i++ {
+		require.Nil(t, m.SendData(context.Background(), &data.Metrics{}))
+	}
+	n, err := s.Len()
+	require.Nil(t, err)
+	require.Equal(t, 2, n)
+
+	close(slow.block)
+	require.Nil(t, m.Close(context.Background()))
+	require.Equal(t, 4, len(slow.sent))
+	n, err = s.Len()
+	require.Nil(t, err)
+	require.Equal(t, 0, n)
+}
+
+type closingBackend struct {
+	fakeBackend
+	closed bool
+}
+
+func (c *closingBackend) Close(_ context.Context) error {
+	c.closed = true
+	return nil
+}
+
+func TestClose(t *testing.T) {
+	c := &closingBackend{}
+	m := New([]Named{{Name: "c", Backend: c}, {Name: "f", Backend: &fakeBackend{}}}, 0)
+
+	require.Nil(t, m.SendData(context.Background(), &data.Metrics{}))
+	require.Nil(t, m.Close(context.Background()))
+	require.True(t, c.closed)
+	require.Equal(t, 1, len(c.sent))
+}
+
+type hangingBackend struct{}
+
+func (h *hangingBackend) SendData(ctx context.Context, _ *data.Metrics) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestCloseDeadline(t *testing.T) {
+	m := New([]Named{{Name: "h", Backend: &hangingBackend{}}}, 0)
+	require.Nil(t, m.SendData(context.Background(), &data.Metrics{}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Nil(t, m.Close(ctx))
+	require.EqualError(t, m.SendData(context.Background(), &data.Metrics{}), "backend is closed")
+}
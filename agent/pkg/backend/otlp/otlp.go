@@ -0,0 +1,214 @@
+package otlp
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/backend/httpsend"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/config"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const scopeName = "github.com/dockwizard/dockwizard_agent"
+
+type otlp struct {
+	config *config.Backend
+	client *http.Client
+}
+
+func New(config *config.Backend, client *http.Client) *otlp {
+	return &otlp{
+		config: config,
+		client: httpsend.Client(client),
+	}
+}
+
+func (o *otlp) SendData(ctx context.Context, metrics *data.Metrics) error {
+	req := o.convert(metrics)
+
+	var body []byte
+	var err error
+	contentType := "application/x-protobuf"
+	if o.config.OTLPEncoding == "json" {
+		// OTLP/JSON requires enums as numbers
+		body, err = protojson.MarshalOptions{UseEnumNumbers: true}.Marshal(req)
+		contentType = "application/json"
+	} else {
+		body, err = proto.Marshal(req)
+	}
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := httpsend.NewRequest(ctx, o.config.OTLPEndpoint, o.config.Compression, body)
+	if err != nil {
+		return err
+	}
+	for k, v := range o.config.Headers {
+		httpReq.Header.Set(k, v)
+	}
+	httpReq.Header.Set("Content-Type", contentType)
+
+	// The response is an ExportMetricsServiceResponse on success and a
+	// Status otherwise, only its status code matters here
+	return httpsend.Do(o.client, httpReq, "collector")
+}
+
+// convert turns the metrics into an export request with a resource for the
+// host and one for every container
+func (o *otlp) convert(metrics *data.Metrics) *collectorpb.ExportMetricsServiceRequest {
+	req := &collectorpb.ExportMetricsServiceRequest{}
+
+	var hostAttributes []*commonpb.KeyValue
+	if h := metrics.Host; h != nil {
+		hostAttributes = attributes(
+			"host.name", h.Hostname,
+			"host.id", h.AgentID,
+			"os.description", h.OS,
+			"os.kernel", h.Kernel,
+			"container.runtime.version", h.DockerVersion,
+		)
+		req.ResourceMetrics = append(req.ResourceMetrics, newResourceMetrics(hostAttributes, hostMetrics(h, uint64(h.Timestamp.UnixNano()))))
+	}
+
+	for _, c := range metrics.Container {
+		// Containers without stats have no values to report
+		if !c.HasStats() {
+			continue
+		}
+
+		attrs := append(attributes(
+			"container.id", c.ID,
+			"container.name", c.Name,
+			"container.image.name", c.Image,
+			"container.runtime", "docker",
+			"docker.compose.project", c.ComposeProject,
+			"docker.compose.service", c.ComposeService,
+			"docker.swarm.service", c.SwarmService,
+			"docker.swarm.stack", c.SwarmStack,
+		), hostAttributes...)
+		for k, v := range c.Labels {
+			attrs = append(attrs, attribute("container.label."+k, v))
+		}
+
+		req.ResourceMetrics = append(req.ResourceMetrics, newResourceMetrics(attrs, containerMetrics(c, uint64(c.Timestamp.UnixNano()))))
+	}
+
+	return req
+}
+
+func newResourceMetrics(attrs []*commonpb.KeyValue, metrics []*metricspb.Metric) *metricspb.ResourceMetrics {
+	return &metricspb.ResourceMetrics{
+		Resource: &resourcepb.Resource{Attributes: attrs},
+		ScopeMetrics: []*metricspb.ScopeMetrics{
+			{
+				Scope:   &commonpb.InstrumentationScope{Name: scopeName},
+				Metrics: metrics,
+			},
+		},
+	}
+}
+func hostMetrics(h *data.Host, timestamp uint64) []*metricspb.Metric {
+	return []*metricspb.Metric{
+		newGauge("system.cpu.utilization", "CPU usage of the host", "1", timestamp, ratio(h.CPUUsage)),
+		newGauge("system.cpu.logical.count", "Number of CPUs of the host", "{cpu}", timestamp, float64(h.CPUs)),
+		newGauge("system.memory.usage", "Memory used by the host", "By", timestamp, float64(h.MemoryUsage)),
+		newGauge("system.memory.limit", "Total memory of the host", "By", timestamp, float64(h.MemoryTotal)),
+		newGauge("system.memory.utilization", "Memory used by the host", "1", timestamp, ratio(h.MemoryUsagePercentage)),
+		newGauge("system.cpu.load_average.1m", "Load average over 1 minute", "{thread}", timestamp, h.Load1),
+		newGauge("system.cpu.load_average.5m", "Load average over 5 minutes", "{thread}", timestamp, h.Load5),
+		newGauge("system.cpu.load_average.15m", "Load average over 15 minutes", "{thread}", timestamp, h.Load15),
+		newGauge("system.filesystem.usage", "Space used on the root filesystem", "By", timestamp, float64(h.DiskUsage)),
+		newGauge("system.filesystem.limit", "Size of the root filesystem", "By", timestamp, float64(h.DiskTotal)),
+	}
+}
+
+func containerMetrics(c *data.ContainerMetrics, timestamp uint64) []*metricspb.Metric {
+	// Cumulative sums start counting when the container started
+	var start uint64
+	if c.StartedAt != nil {
+		start = uint64(c.StartedAt.UnixNano())
+	} else if c.Created != nil {
+		start = uint64(c.Created.UnixNano())
+	}
+
+	return []*metricspb.Metric{
+		newGauge("container.cpu.utilization", "CPU usage of the container", "1", timestamp, ratio(c.CPUUsage)),
+		newGauge("container.memory.usage", "Memory used by the container", "By", timestamp, float64(c.MemoryUsage)),
+		newGauge("container.memory.utilization", "Memory used by the container relative to its limit", "1", timestamp, ratio(c.MemoryUsagePercentage)),
+		newSum("container.network.io", "Bytes sent and received by the container over the network", "By", start, timestamp,
+			"network.io.direction", "receive", float64(c.NetworkIORead),
+			"network.io.direction", "transmit", float64(c.NetworkIOWrite)),
+		newSum("container.disk.io", "Bytes read and written by the container on block devices", "By", start, timestamp,
+			"disk.io.direction", "read", float64(c.BlockIORead),
+			"disk.io.direction", "write", float64(c.BlockIOWrite)),
+	}
+}
+
+// ratio converts a percentage to the 0-1 ratio utilization metrics are
+// reported in
+func ratio(percentage float64) float64 {
+	return percentage / 100
+}
+
+func newGauge(name, description, unit string, timestamp uint64, value float64) *metricspb.Metric {
+	return &metricspb.Metric{
+		Name:        name,
+		Description: description,
+		Unit:        unit,
+		Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{
+			DataPoints: []*metricspb.NumberDataPoint{{
+				TimeUnixNano: timestamp,
+				Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: value},
+			}},
+		}},
+	}
+}
+
+// newSum returns a cumulative, monotonic sum with a data point for every
+// attribute key, value and data point value triple in points
+func newSum(name, description, unit string, start, timestamp uint64, points ...interface{}) *metricspb.Metric {
+	s := &metricspb.Sum{
+		AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+		IsMonotonic:            true,
+	}
+	for i := 0; i+2 < len(points); i += 3 {
+		s.DataPoints = append(s.DataPoints, &metricspb.NumberDataPoint{
+			Attributes:        attributes(points[i].(string), points[i+1].(string)),
+			StartTimeUnixNano: start,
+			TimeUnixNano:      timestamp,
+			Value:             &metricspb.NumberDataPoint_AsDouble{AsDouble: points[i+2].(float64)},
+		})
+	}
+	return &metricspb.Metric{
+		Name:        name,
+		Description: description,
+		Unit:        unit,
+		Data:        &metricspb.Metric_Sum{Sum: s},
+	}
+}
+
+// attributes returns the key/value pairs as attributes, skipping empty values
+func attributes(pairs ...string) []*commonpb.KeyValue {
+	var ret []*commonpb.KeyValue
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] == "" {
+			continue
+		}
+		ret = append(ret, attribute(pairs[i], pairs[i+1]))
+	}
+	return ret
+}
+
+func attribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key:   key,
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}},
+	}
+}
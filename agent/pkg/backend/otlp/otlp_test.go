@@ -0,0 +1,195 @@
+package otlp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/config"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+	"github.com/stretchr/testify/require"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+var started = time.Unix(1700000000, 0)
+
+func testMetrics() *data.Metrics {
+	return &data.Metrics{
+		Host: &data.Host{
+			AgentID:   "agent-1",
+			Hostname:  "docker-1",
+			CPUUsage:  12.5,
+			Timestamp: started.Add(time.Minute),
+		},
+		Container: []*data.ContainerMetrics{
+			{
+				ID:             "1",
+				Name:           "web",
+				Image:          "nginx",
+				State:          "running",
+				CPUUsage:       1.5,
+				MemoryUsage:    1024,
+				NetworkIORead:  100,
+				NetworkIOWrite: 200,
+				BlockIORead:    300,
+				BlockIOWrite:   400,
+				StartedAt:      &started,
+				Timestamp:      started.Add(30 * time.Second),
+				Labels:         map[string]string{"tier": "frontend"},
+			},
+			{ID: "2", Name: "stopped", State: "exited"},
+		},
+	}
+}
+
+// collector starts a collector that stores the last request it received
+func collector(t *testing.T, status int) (*httptest.Server, *http.Request, *[]byte) {
+	var req http.Request
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reader io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			require.Nil(t, err)
+			reader = gz
+		}
+		bts, err := io.ReadAll(reader)
+		require.Nil(t, err)
+
+		req = *r
+		body = bts
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &req, &body
+}
+
+func TestSendDataJSON(t *testing.T) {
+	srv, req, body := collector(t, http.StatusOK)
+
+	o := New(&config.Backend{
+		OTLPEndpoint: srv.URL + "/v1/metrics",
+		OTLPEncoding: "json",
+		Headers:      map[string]string{"Authorization": "Bearer 123"},
+	}, nil)
+
+	err := o.SendData(context.Background(), testMetrics())
+	require.Nil(t, err)
+	require.Equal(t, "/v1/metrics", req.URL.Path)
+	require.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	require.Equal(t, "Bearer 123", req.Header.Get("Authorization"))
+
+	// OTLP/JSON sends enums as numbers and 64 bit integers as strings
+	var compact bytes.Buffer
+	require.Nil(t, json.Compact(&compact, *body))
+	require.Contains(t, compact.String(), `"aggregationTemporality":2`)
+	require.Contains(t, compact.String(), `"timeUnixNano":"1700000030000000000"`)
+
+	var received collectorpb.ExportMetricsServiceRequest
+	require.Nil(t, protojson.Unmarshal(*body, &received))
+
+	// The host and the running container, the stopped one has no stats
+	require.Len(t, received.ResourceMetrics, 2)
+	require.Equal(t, map[string]string{"host.name": "docker-1", "host.id": "agent-1"}, attributeMap(received.ResourceMetrics[0].Resource.Attributes))
+
+	cpu := received.ResourceMetrics[0].ScopeMetrics[0].Metrics[0]
+	require.Equal(t, "system.cpu.utilization", cpu.Name)
+	require.Equal(t, "1", cpu.Unit)
+	require.Equal(t, 0.125, cpu.GetGauge().DataPoints[0].GetAsDouble())
+
+	require.Equal(t, uint64(started.Add(time.Minute).UnixNano()), cpu.GetGauge().DataPoints[0].TimeUnixNano)
+
+	container := attributeMap(received.ResourceMetrics[1].Resource.Attributes)
+	require.Equal(t, "1", container["container.id"])
+	require.Equal(t, "frontend", container["container.label.tier"])
+	require.Equal(t, "docker-1", container["host.name"])
+
+	metrics := metricsByName(received.ResourceMetrics[1])
+	require.Equal(t, 0.015, metrics["container.cpu.utilization"].GetGauge().DataPoints[0].GetAsDouble())
+	require.Equal(t, 1024.0, metrics["container.memory.usage"].GetGauge().DataPoints[0].GetAsDouble())
+	require.Equal(t, 300.0, metrics["container.disk.io"].GetSum().DataPoints[0].GetAsDouble())
+}
+
+func TestSendDataProtobuf(t *testing.T) {
+	srv, req, body := collector(t, http.StatusOK)
+
+	o := New(&config.Backend{OTLPEndpoint: srv.URL, OTLPEncoding: "protobuf", Compression: "gzip"}, nil)
+
+	err := o.SendData(context.Background(), testMetrics())
+	require.Nil(t, err)
+	require.Equal(t, "application/x-protobuf", req.Header.Get("Content-Type"))
+	require.Equal(t, "gzip", req.Header.Get("Content-Encoding"))
+
+	var received collectorpb.ExportMetricsServiceRequest
+	require.Nil(t, proto.Unmarshal(*body, &received))
+	require.Len(t, received.ResourceMetrics, 2)
+
+	host := received.ResourceMetrics[0]
+	require.Equal(t, map[string]string{"host.name": "docker-1", "host.id": "agent-1"}, attributeMap(host.Resource.Attributes))
+	require.Equal(t, scopeName, host.ScopeMetrics[0].Scope.Name)
+	require.Equal(t, 0.125, metricsByName(host)["system.cpu.utilization"].GetGauge().DataPoints[0].GetAsDouble())
+
+	container := received.ResourceMetrics[1]
+	require.Equal(t, "1", attributeMap(container.Resource.Attributes)["container.id"])
+
+	var names []string
+	for _, m := range container.ScopeMetrics[0].Metrics {
+		names = append(names, m.Name)
+	}
+	require.Equal(t, []string{
+		"container.cpu.utilization",
+		"container.memory.usage",
+		"container.memory.utilization",
+		"container.network.io",
+		"container.disk.io",
+	}, names)
+
+	network := metricsByName(container)["container.network.io"].GetSum()
+	require.True(t, network.IsMonotonic)
+	require.Equal(t, metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE, network.AggregationTemporality)
+	require.Len(t, network.DataPoints, 2)
+	transmit := network.DataPoints[1]
+	require.Equal(t, map[string]string{"network.io.direction": "transmit"}, attributeMap(transmit.Attributes))
+	require.Equal(t, uint64(started.UnixNano()), transmit.StartTimeUnixNano)
+	require.Equal(t, uint64(started.Add(30*time.Second).UnixNano()), transmit.TimeUnixNano)
+	require.Equal(t, 200.0, transmit.GetAsDouble())
+}
+
+func TestSendDataError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid metrics", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	o := New(&config.Backend{OTLPEndpoint: srv.URL}, nil)
+	err := o.SendData(context.Background(), testMetrics())
+	require.EqualError(t, err, "collector responded with 400 Bad Request: invalid metrics")
+}
+
+// attributeMap returns the string attributes by key
+func attributeMap(attrs []*commonpb.KeyValue) map[string]string {
+	ret := map[string]string{}
+	for _, attr := range attrs {
+		ret[attr.Key] = attr.Value.GetStringValue()
+	}
+	return ret
+}
+
+// metricsByName returns the metrics of the first scope of the resource
+func metricsByName(rm *metricspb.ResourceMetrics) map[string]*metricspb.Metric {
+	ret := map[string]*metricspb.Metric{}
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		ret[m.Name] = m
+	}
+	return ret
+}
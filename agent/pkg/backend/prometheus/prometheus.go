@@ -0,0 +1,493 @@
+package prometheus
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type metric struct {
+	name  string
+	help  string
+	kind  string
+	value func(c *data.ContainerMetrics) float64
+}
+
+var metrics = []metric{
+	{
+		name:  "dockwizard_container_cpu_usage_percent",
+		help:  "CPU usage of the container in percent",
+		kind:  "gauge",
+		value: func(c *data.ContainerMetrics) float64 { return c.CPUUsage },
+	},
+	{
+		name:  "dockwizard_container_cpu_user_percent",
+		help:  "CPU usage of the container in user mode in percent",
+		kind:  "gauge",
+		value: func(c *data.ContainerMetrics) float64 { return c.CPUUserPercentage },
+	},
+	{
+		name:  "dockwizard_container_cpu_system_percent",
+		help:  "CPU usage of the container in kernel mode in percent",
+		kind:  "gauge",
+		value: func(c *data.ContainerMetrics) float64 { return c.CPUSystemPercentage },
+	},
+	{
+		name:  "dockwizard_container_cpu_limit_cores",
+		help:  "Number of CPUs the container may use, 0 if unlimited",
+		kind:  "gauge",
+		value: func(c *data.ContainerMetrics) float64 { return c.CPULimit },
+	},
+	{
+		name:  "dockwizard_container_cpu_periods_total",
+		help:  "CPU enforcement periods that elapsed for the container",
+		kind:  "counter",
+		value: func(c *data.ContainerMetrics) float64 { return float64(c.CPUPeriods) },
+	},
+	{
+		name:  "dockwizard_container_cpu_throttled_periods_total",
+		help:  "CPU enforcement periods the container was throttled in",
+		kind:  "counter",
+		value: func(c *data.ContainerMetrics) float64 { return float64(c.CPUThrottledPeriods) },
+	},
+	{
+		name:  "dockwizard_container_cpu_throttled_seconds_total",
+		help:  "Time the container was throttled in seconds",
+		kind:  "counter",
+		value: func(c *data.ContainerMetrics) float64 { return float64(c.CPUThrottledTime) / 1e9 },
+	},
+	{
+		name:  "dockwizard_container_pids",
+		help:  "Number of processes in the container",
+		kind:  "gauge",
+		value: func(c *data.ContainerMetrics) float64 { return float64(c.PIDs) },
+	},
+	{
+		name:  "dockwizard_container_pids_limit",
+		help:  "Maximum number of processes in the container, 0 if unlimited",
+		kind:  "gauge",
+		value: func(c *data.ContainerMetrics) float64 { return float64(c.PIDsLimit) },
+	},
+	{
+		name:  "dockwizard_container_memory_usage_bytes",
+		help:  "Memory used by the container in bytes",
+		kind:  "gauge",
+		value: func(c *data.ContainerMetrics) float64 { return float64(c.MemoryUsage) },
+	},
+	{
+		name:  "dockwizard_container_memory_usage_percent",
+		help:  "Memory used by the container in percent of its limit",
+		kind:  "gauge",
+		value: func(c *data.ContainerMetrics) float64 { return c.MemoryUsagePercentage },
+	},
+	{
+		name:  "dockwizard_container_network_receive_bytes_total",
+		help:  "Bytes received by the container over the network",
+		kind:  "counter",
+		value: func(c *data.ContainerMetrics) float64 { return float64(c.NetworkIORead) },
+	},
+	{
+		name:  "dockwizard_container_network_transmit_bytes_total",
+		help:  "Bytes sent by the container over the network",
+		kind:  "counter",
+		value: func(c *data.ContainerMetrics) float64 { return float64(c.NetworkIOWrite) },
+	},
+	{
+		name:  "dockwizard_container_block_io_read_bytes_total",
+		help:  "Bytes read by the container from block devices",
+		kind:  "counter",
+		value: func(c *data.ContainerMetrics) float64 { return float64(c.BlockIORead) },
+	},
+	{
+		name:  "dockwizard_container_block_io_write_bytes_total",
+		help:  "Bytes written by the container to block devices",
+		kind:  "counter",
+		value: func(c *data.ContainerMetrics) float64 { return float64(c.BlockIOWrite) },
+	},
+}
+
+type rateMetric struct {
+	name  string
+	help  string
+	value func(r *data.ContainerRates) float64
+}
+
+var rateMetrics = []rateMetric{
+	{
+		name:  "dockwizard_container_network_receive_bytes_per_second",
+		help:  "Bytes received by the container over the network per second",
+		value: func(r *data.ContainerRates) float64 { return r.NetworkRxBytes },
+	},
+	{
+		name:  "dockwizard_container_network_transmit_bytes_per_second",
+		help:  "Bytes sent by the container over the network per second",
+		value: func(r *data.ContainerRates) float64 { return r.NetworkTxBytes },
+	},
+	{
+		name:  "dockwizard_container_network_receive_packets_per_second",
+		help:  "Packets received by the container over the network per second",
+		value: func(r *data.ContainerRates) float64 { return r.NetworkRxPackets },
+	},
+	{
+		name:  "dockwizard_container_network_transmit_packets_per_second",
+		help:  "Packets sent by the container over the network per second",
+		value: func(r *data.ContainerRates) float64 { return r.NetworkTxPackets },
+	},
+	{
+		name:  "dockwizard_container_block_io_read_bytes_per_second",
+		help:  "Bytes read by the container from block devices per second",
+		value: func(r *data.ContainerRates) float64 { return r.BlockIORead },
+	},
+	{
+		name:  "dockwizard_container_block_io_write_bytes_per_second",
+		help:  "Bytes written by the container to block devices per second",
+		value: func(r *data.ContainerRates) float64 { return r.BlockIOWrite },
+	},
+	{
+		name:  "dockwizard_container_cpu_throttled_percent",
+		help:  "Percentage of CPU periods the container was throttled in since the previous poll",
+		value: func(r *data.ContainerRates) float64 { return r.CPUThrottledPercentage },
+	},
+}
+
+type hostMetric struct {
+	name  string
+	help  string
+	value func(h *data.Host) float64
+}
+
+var hostMetrics = []hostMetric{
+	{
+		name:  "dockwizard_host_cpus",
+		help:  "Number of CPUs of the host",
+		value: func(h *data.Host) float64 { return float64(h.CPUs) },
+	},
+	{
+		name:  "dockwizard_host_cpu_usage_percent",
+		help:  "CPU usage of the host in percent",
+		value: func(h *data.Host) float64 { return h.CPUUsage },
+	},
+	{
+		name:  "dockwizard_host_memory_total_bytes",
+		help:  "Total memory of the host in bytes",
+		value: func(h *data.Host) float64 { return float64(h.MemoryTotal) },
+	},
+	{
+		name:  "dockwizard_host_memory_usage_bytes",
+		help:  "Memory used by the host in bytes",
+		value: func(h *data.Host) float64 { return float64(h.MemoryUsage) },
+	},
+	{
+		name:  "dockwizard_host_load1",
+		help:  "Load average of the host over 1 minute",
+		value: func(h *data.Host) float64 { return h.Load1 },
+	},
+	{
+		name:  "dockwizard_host_load5",
+		help:  "Load average of the host over 5 minutes",
+		value: func(h *data.Host) float64 { return h.Load5 },
+	},
+	{
+		name:  "dockwizard_host_load15",
+		help:  "Load average of the host over 15 minutes",
+		value: func(h *data.Host) float64 { return h.Load15 },
+	},
+	{
+		name:  "dockwizard_host_disk_total_bytes",
+		help:  "Size of the root filesystem of the host in bytes",
+		value: func(h *data.Host) float64 { return float64(h.DiskTotal) },
+	},
+	{
+		name:  "dockwizard_host_disk_usage_bytes",
+		help:  "Space used on the root filesystem of the host in bytes",
+		value: func(h *data.Host) float64 { return float64(h.DiskUsage) },
+	},
+}
+
+type prometheus struct {
+	mu      sync.RWMutex
+	metrics *data.Metrics
+	// events counts the events received per container ID and label set
+	events map[string]map[string]float64
+
+	server *http.Server
+}
+
+// New starts an exporter serving the last metrics sent to it on addr
+func New(addr string) (*prometheus, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &prometheus{
+		metrics: &data.Metrics{},
+		events:  map[string]map[string]float64{},
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", p)
+	p.server = &http.Server{Handler: mux}
+	go p.server.Serve(l)
+
+	return p, nil
+}
+
+func (p *prometheus) SendData(_ context.Context, metrics *data.Metrics) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.metrics = metrics
+
+	// Only containers that are still listed or had events keep their
+	// series, so removed containers do not pile up
+	ids := map[string]bool{}
+	for _, c := range metrics.Container {
+		ids[c.ID] = true
+	}
+	for _, event := range metrics.Events {
+		ids[event.ID] = true
+		if p.events[event.ID] == nil {
+			p.events[event.ID] = map[string]float64{}
+		}
+		p.events[event.ID][labels(
+			"id", event.ID,
+			"name", event.Name,
+			"image", event.Image,
+			"action", event.Action,
+		)]++
+	}
+	for id := range p.events {
+		if !ids[id] {
+			delete(p.events, id)
+		}
+	}
+	return nil
+}
+
+// Close stops the exporter, waiting for running scrapes until ctx is done
+func (p *prometheus) Close(ctx context.Context) error {
+	return p.server.Shutdown(ctx)
+}
+
+func (p *prometheus) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+
+	bw := bufio.NewWriter(w)
+	p.write(bw)
+	bw.Flush()
+}
+
+// write writes the metrics in the Prometheus text exposition format
+func (p *prometheus) write(w *bufio.Writer) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+		for _, c := range p.metrics.Container {
+			// Containers without stats only report their state
+			if !c.HasStats() {
+				continue
+			}
+			fmt.Fprintf(w, "%s{%s} %s\n", m.name, containerLabels(c), formatFloat(m.value(c)))
+		}
+	}
+
+	// Rates are only known from the second sample of a container on
+	for _, m := range rateMetrics {
+		fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", m.name)
+		for _, c := range p.metrics.Container {
+			if c.Rates == nil {
+				continue
+			}
+			fmt.Fprintf(w, "%s{%s} %s\n", m.name, containerLabels(c), formatFloat(m.value(c.Rates)))
+		}
+	}
+
+	const info = "dockwizard_container_info"
+	fmt.Fprintf(w, "# HELP %s Metadata of the container, always 1\n", info)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", info)
+	for _, c := range p.metrics.Container {
+		fmt.Fprintf(w, "%s{%s} 1\n", info, infoLabels(c))
+	}
+
+	const started = "dockwizard_container_start_time_seconds"
+	fmt.Fprintf(w, "# HELP %s Time the container was last started as a unix timestamp\n", started)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", started)
+	for _, c := range p.metrics.Container {
+		if c.StartedAt != nil {
+			fmt.Fprintf(w, "%s{%s} %d\n", started, containerLabels(c), c.StartedAt.Unix())
+		}
+	}
+
+	const collectionError = "dockwizard_container_collection_error"
+	fmt.Fprintf(w, "# HELP %s Whether the stats of the container could not be collected\n", collectionError)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", collectionError)
+	for _, c := range p.metrics.Container {
+		fmt.Fprintf(w, "%s{%s} %s\n", collectionError, containerLabels(c), formatFloat(boolToFloat(c.Error != "")))
+	}
+
+	const exitCode = "dockwizard_container_exit_code"
+	fmt.Fprintf(w, "# HELP %s Exit code of the last run of a container that is not running\n", exitCode)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", exitCode)
+	for _, c := range p.metrics.Container {
+		if c.ExitCode != nil {
+			fmt.Fprintf(w, "%s{%s} %d\n", exitCode, containerLabels(c), *c.ExitCode)
+		}
+	}
+
+	const restarts = "dockwizard_container_restart_count"
+	fmt.Fprintf(w, "# HELP %s Times a container that is not running was restarted by its restart policy\n", restarts)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", restarts)
+	for _, c := range p.metrics.Container {
+		if c.ExitCode != nil {
+			fmt.Fprintf(w, "%s{%s} %d\n", restarts, containerLabels(c), c.RestartCount)
+		}
+	}
+
+	const health = "dockwizard_container_health_check_healthy"
+	fmt.Fprintf(w, "# HELP %s Whether the health check passed (1) or failed (0)\n", health)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", health)
+	for _, c := range p.metrics.Container {
+		for _, check := range c.HealthChecks {
+			fmt.Fprintf(w, "%s{%s,%s} %s\n", health, containerLabels(c), labels(
+				"type", check.Type,
+				"target", check.Target,
+			), formatFloat(boolToFloat(check.Healthy)))
+		}
+	}
+
+	if h := p.metrics.Host; h != nil {
+		const info = "dockwizard_host_info"
+		fmt.Fprintf(w, "# HELP %s Identity of the host, always 1\n", info)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", info)
+		fmt.Fprintf(w, "%s{%s,%s} 1\n", info, hostLabels(h), labels(
+			"os", h.OS,
+			"kernel", h.Kernel,
+			"docker_version", h.DockerVersion,
+		))
+
+		for _, m := range hostMetrics {
+			fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+			fmt.Fprintf(w, "# TYPE %s gauge\n", m.name)
+			fmt.Fprintf(w, "%s{%s} %s\n", m.name, hostLabels(h), formatFloat(m.value(h)))
+		}
+	}
+
+	const events = "dockwizard_container_events_total"
+	fmt.Fprintf(w, "# HELP %s Container lifecycle events seen by the agent\n", events)
+	fmt.Fprintf(w, "# TYPE %s counter\n", events)
+	counts := map[string]float64{}
+	for _, byLabels := range p.events {
+		for k, v := range byLabels {
+			counts[k] = v
+		}
+	}
+	var keys []string
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s} %s\n", events, k, formatFloat(counts[k]))
+	}
+}
+
+func containerLabels(c *data.ContainerMetrics) string {
+	return labels(
+		"id", c.ID,
+		"name", c.Name,
+		"image", c.Image,
+		"state", c.State,
+	)
+}
+
+// infoLabels are the container labels plus its metadata
+// The allowed container labels are prefixed with "label_" and sanitized into
+// valid label names. Labels that end up with the same name, e.g. "a.b" and
+// "a_b", only keep the first in sort order as Prometheus rejects the scrape
+// on duplicates
+func infoLabels(c *data.ContainerMetrics) string {
+	ret := containerLabels(c) + "," + labels(
+		"health_status", c.HealthStatus,
+		"compose_project", c.ComposeProject,
+		"compose_service", c.ComposeService,
+		"swarm_service", c.SwarmService,
+		"swarm_stack", c.SwarmStack,
+		"image_id", c.ImageID,
+		"image_digest", c.ImageDigest,
+		"restart_policy", c.RestartPolicy,
+	)
+
+	var keys []string
+	for k := range c.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	seen := map[string]bool{}
+	for _, k := range keys {
+		name := "label_" + labelName(k)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		ret += "," + labels(name, c.Labels[k])
+	}
+	return ret
+}
+
+// labelName replaces the characters not allowed in a label name with "_"
+func labelName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+func hostLabels(h *data.Host) string {
+	return labels(
+		"agent_id", h.AgentID,
+		"hostname", h.Hostname,
+	)
+}
+
+// labels formats name/value pairs as a label set without the braces
+func labels(pairs ...string) string {
+	var parts []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=\"%s\"", pairs[i], escape(pairs[i+1])))
+	}
+	return strings.Join(parts, ",")
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
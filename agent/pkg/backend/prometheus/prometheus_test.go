@@ -0,0 +1,152 @@
+package prometheus
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	p, err := New("127.0.0.1:0")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(p.metrics.Container))
+	require.Nil(t, p.Close(context.Background()))
+}
+
+func TestServeHTTP(t *testing.T) {
+	p := &prometheus{metrics: &data.Metrics{}, events: map[string]map[string]float64{}}
+	for i := 0; i < 2; i++ {
+		err := p.SendData(context.Background(), &data.Metrics{
+			Events: []*data.ContainerEvent{
+				{ID: "1", Name: "web", Image: "nginx", Action: "restart"},
+			},
+		})
+		require.Nil(t, err)
+	}
+
+	exitCode := 137
+	err := p.SendData(context.Background(), &data.Metrics{
+		Host: &data.Host{
+			AgentID:       "abc",
+			Hostname:      "node-1",
+			OS:            "Debian GNU/Linux 12 (bookworm)",
+			Kernel:        "6.1.0",
+			DockerVersion: "24.0.5",
+			MemoryTotal:   8589934592,
+			Load1:         0.5,
+		},
+		Container: []*data.ContainerMetrics{
+			{
+				ID:             "1",
+				Name:           "web",
+				Image:          `my"image`,
+				State:          "running",
+				ComposeProject: "shop",
+				Labels:         map[string]string{"com.acme.team": "checkout"},
+				CPUUsage:       1.5,
+				PIDs:           12,
+				MemoryUsage:    4194304,
+				NetworkIORead:  37188,
+				NetworkIOWrite: 10036,
+				Rates: &data.ContainerRates{
+					Interval:       2,
+					NetworkRxBytes: 512,
+				},
+				HealthChecks: []*data.HealthCheckResult{
+					{Type: "tcp", Target: "10.0.0.2:80", Healthy: true},
+				},
+			},
+			{
+				ID:    "2",
+				Name:  "gone",
+				State: "exited",
+				Error: "Error: No such container: 2",
+			},
+			{
+				ID:           "3",
+				Name:         "job",
+				State:        "exited",
+				ExitCode:     &exitCode,
+				RestartCount: 2,
+			},
+		},
+	})
+	require.Nil(t, err)
+
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	res, err := srv.Client().Get(srv.URL)
+	require.Nil(t, err)
+	bts, err := io.ReadAll(res.Body)
+	require.Nil(t, err)
+	body := string(bts)
+
+	require.Equal(t, contentType, res.Header.Get("Content-Type"))
+	labels := `id="1",name="web",image="my\"image",state="running"`
+	require.Contains(t, body, "# TYPE dockwizard_container_cpu_usage_percent gauge\n")
+	require.Contains(t, body, "dockwizard_container_cpu_usage_percent{"+labels+"} 1.5\n")
+	require.Contains(t, body, "dockwizard_container_memory_usage_bytes{"+labels+"} 4194304\n")
+	require.Contains(t, body, "dockwizard_container_pids{"+labels+"} 12\n")
+	require.Contains(t, body, "# TYPE dockwizard_container_network_receive_bytes_total counter\n")
+	require.Contains(t, body, "dockwizard_container_network_receive_bytes_total{"+labels+"} 37188\n")
+	require.Contains(t, body, "dockwizard_container_health_check_healthy{"+labels+`,type="tcp",target="10.0.0.2:80"} 1`+"\n")
+	require.Contains(t, body, "dockwizard_container_network_receive_bytes_per_second{"+labels+"} 512\n")
+	require.Contains(t, body, "dockwizard_container_collection_error{"+labels+"} 0\n")
+
+	require.Contains(t, body, "dockwizard_container_info{"+labels+`,health_status="",compose_project="shop",compose_service="",swarm_service="",swarm_stack="",image_id="",image_digest="",restart_policy="",label_com_acme_team="checkout"} 1`+"\n")
+
+	stopped := `id="3",name="job",image="",state="exited"`
+	require.Contains(t, body, "dockwizard_container_exit_code{"+stopped+"} 137\n")
+	require.Contains(t, body, "dockwizard_container_restart_count{"+stopped+"} 2\n")
+	require.NotContains(t, body, "dockwizard_container_cpu_usage_percent{"+stopped+"}")
+
+	hostLabels := `agent_id="abc",hostname="node-1"`
+	require.Contains(t, body, "dockwizard_host_info{"+hostLabels+`,os="Debian GNU/Linux 12 (bookworm)",kernel="6.1.0",docker_version="24.0.5"} 1`+"\n")
+	require.Contains(t, body, "dockwizard_host_memory_total_bytes{"+hostLabels+"} 8589934592\n")
+	require.Contains(t, body, "dockwizard_host_load1{"+hostLabels+"} 0.5\n")
+
+	require.Contains(t, body, `dockwizard_container_events_total{id="1",name="web",image="nginx",action="restart"} 2`+"\n")
+
+	goneLabels := `id="2",name="gone",image="",state="exited"`
+	require.Contains(t, body, "dockwizard_container_collection_error{"+goneLabels+"} 1\n")
+	require.NotContains(t, body, "dockwizard_container_cpu_usage_percent{"+goneLabels+"}")
+}
+
+func TestEventsPruned(t *testing.T) {
+	p := &prometheus{metrics: &data.Metrics{}, events: map[string]map[string]float64{}}
+	err := p.SendData(context.Background(), &data.Metrics{
+		Events: []*data.ContainerEvent{
+			{ID: "1", Name: "ci-1", Action: "die"},
+			{ID: "2", Name: "web", Action: "restart"},
+		},
+	})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(p.events))
+
+	// The CI container is gone, the web container is still listed
+	err = p.SendData(context.Background(), &data.Metrics{
+		Container: []*data.ContainerMetrics{{ID: "2", Name: "web", State: "running"}},
+	})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(p.events))
+	require.NotNil(t, p.events["2"])
+}
+
+func TestInfoLabelsDuplicates(t *testing.T) {
+	c := &data.ContainerMetrics{
+		ID: "1",
+		Labels: map[string]string{
+			"com_acme_team": "payments",
+			"com.acme.team": "checkout",
+			"a-b":           "1",
+			"a.b":           "2",
+		},
+	}
+	require.True(t, strings.HasSuffix(infoLabels(c), `,label_a_b="1",label_com_acme_team="checkout"`))
+}
@@ -0,0 +1,209 @@
+package statsd
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/config"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+)
+
+type gauge struct {
+	name  string
+	value func(c *data.ContainerMetrics) float64
+}
+
+var containerGauges = []gauge{
+	{"cpu_usage", func(c *data.ContainerMetrics) float64 { return c.CPUUsage }},
+	{"cpu_user_percentage", func(c *data.ContainerMetrics) float64 { return c.CPUUserPercentage }},
+	{"cpu_system_percentage", func(c *data.ContainerMetrics) float64 { return c.CPUSystemPercentage }},
+	{"cpu_limit", func(c *data.ContainerMetrics) float64 { return c.CPULimit }},
+	{"cpu_periods", func(c *data.ContainerMetrics) float64 { return float64(c.CPUPeriods) }},
+	{"cpu_throttled_periods", func(c *data.ContainerMetrics) float64 { return float64(c.CPUThrottledPeriods) }},
+	{"cpu_throttled_time", func(c *data.ContainerMetrics) float64 { return float64(c.CPUThrottledTime) }},
+	{"cpu_throttled_percentage", func(c *data.ContainerMetrics) float64 { return c.CPUThrottledPercentage }},
+	{"pids", func(c *data.ContainerMetrics) float64 { return float64(c.PIDs) }},
+	{"pids_limit", func(c *data.ContainerMetrics) float64 { return float64(c.PIDsLimit) }},
+	{"memory_usage", func(c *data.ContainerMetrics) float64 { return float64(c.MemoryUsage) }},
+	{"memory_usage_percentage", func(c *data.ContainerMetrics) float64 { return c.MemoryUsagePercentage }},
+	{"network_io_read", func(c *data.ContainerMetrics) float64 { return float64(c.NetworkIORead) }},
+	{"network_io_write", func(c *data.ContainerMetrics) float64 { return float64(c.NetworkIOWrite) }},
+	{"block_io_read", func(c *data.ContainerMetrics) float64 { return float64(c.BlockIORead) }},
+	{"block_io_write", func(c *data.ContainerMetrics) float64 { return float64(c.BlockIOWrite) }},
+}
+
+var hostGauges = []struct {
+	name  string
+	value func(h *data.Host) float64
+}{
+	{"cpus", func(h *data.Host) float64 { return float64(h.CPUs) }},
+	{"cpu_usage", func(h *data.Host) float64 { return h.CPUUsage }},
+	{"memory_total", func(h *data.Host) float64 { return float64(h.MemoryTotal) }},
+	{"memory_usage", func(h *data.Host) float64 { return float64(h.MemoryUsage) }},
+	{"memory_usage_percentage", func(h *data.Host) float64 { return h.MemoryUsagePercentage }},
+	{"load1", func(h *data.Host) float64 { return h.Load1 }},
+	{"load5", func(h *data.Host) float64 { return h.Load5 }},
+	{"load15", func(h *data.Host) float64 { return h.Load15 }},
+	{"disk_total", func(h *data.Host) float64 { return float64(h.DiskTotal) }},
+	{"disk_usage", func(h *data.Host) float64 { return float64(h.DiskUsage) }},
+	{"disk_usage_percentage", func(h *data.Host) float64 { return h.DiskUsagePercentage }},
+}
+
+var (
+	// invalidNameChars are the characters not allowed in a metric name
+	// segment, dots would add a level to the hierarchy
+	invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+	// tagEscaper replaces the characters that separate tags
+	tagEscaper = strings.NewReplacer(",", "_", "|", "_", "\n", "_")
+)
+
+type statsd struct {
+	config *config.Backend
+}
+
+func New(config *config.Backend) *statsd {
+	return &statsd{
+		config: config,
+	}
+}
+
+func (s *statsd) SendData(ctx context.Context, metrics *data.Metrics) error {
+	lines := s.encode(metrics)
+	if len(lines) == 0 {
+		return nil
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", s.config.StatsdAddress)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, packet := range pack(lines, s.config.StatsdMaxPacketSize) {
+		_, err = conn.Write(packet)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encode returns a gauge line for every metric of the host and the containers
+func (s *statsd) encode(metrics *data.Metrics) []string {
+	var lines []string
+
+	var hostname string
+	if h := metrics.Host; h != nil {
+		hostname = h.Hostname
+		tags := s.tags("host", h.Hostname) + s.timestamp(h.Timestamp)
+		for _, g := range hostGauges {
+			lines = append(lines, s.line("host", nil, g.name, g.value(h), tags))
+		}
+	}
+
+	for _, c := range metrics.Container {
+		// Containers without stats have no values to report
+		if !c.HasStats() {
+			continue
+		}
+
+		// Plain StatsD has no tags, the container is part of the name instead
+		var segments []string
+		if s.config.StatsdFlavor != "dogstatsd" {
+			segments = []string{c.Name}
+		}
+		tags := s.tags(
+			"container_id", c.ID,
+			"container_name", c.Name,
+			"image", c.Image,
+			"host", hostname,
+			"compose_project", c.ComposeProject,
+			"compose_service", c.ComposeService,
+		) + s.timestamp(c.Timestamp)
+		for _, g := range containerGauges {
+			lines = append(lines, s.line("container", segments, g.name, g.value(c), tags))
+		}
+	}
+
+	return lines
+}
+
+// line formats a single gauge, e.g. "dockwizard.container.cpu_usage:1.5|g"
+// followed by the tags and timestamp suffix
+func (s *statsd) line(group string, segments []string, name string, value float64, suffix string) string {
+	var b strings.Builder
+	if s.config.StatsdPrefix != "" {
+		b.WriteString(s.config.StatsdPrefix)
+		b.WriteByte('.')
+	}
+	b.WriteString(group)
+	for _, segment := range segments {
+		b.WriteByte('.')
+		b.WriteString(invalidNameChars.ReplaceAllString(segment, "_"))
+	}
+	b.WriteByte('.')
+	b.WriteString(name)
+	b.WriteByte(':')
+	b.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+	b.WriteString("|g")
+	b.WriteString(suffix)
+	return b.String()
+}
+
+// tags returns the DogStatsD tags suffix for the key/value pairs, e.g.
+// "|#container_name:web,image:nginx", leaving out empty values
+// It is empty unless the flavor is "dogstatsd"
+func (s *statsd) tags(pairs ...string) string {
+	if s.config.StatsdFlavor != "dogstatsd" {
+		return ""
+	}
+
+	var tags []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] == "" {
+			continue
+		}
+		tags = append(tags, pairs[i]+":"+tagEscaper.Replace(pairs[i+1]))
+	}
+	if len(tags) == 0 {
+		return ""
+	}
+	return "|#" + strings.Join(tags, ",")
+}
+
+// timestamp returns the DogStatsD timestamp suffix, e.g. "|T1700000000", so
+// the sample is recorded at the time it was collected instead of when it
+// arrives. Plain StatsD has no timestamps, the server uses the arrival time
+func (s *statsd) timestamp(t time.Time) string {
+	if s.config.StatsdFlavor != "dogstatsd" || t.IsZero() {
+		return ""
+	}
+	return "|T" + strconv.FormatInt(t.Unix(), 10)
+}
+
+// pack joins the lines into packets of at most size bytes
+// A line is never split, a line longer than size is sent on its own
+func pack(lines []string, size int) [][]byte {
+	var packets [][]byte
+	var packet []byte
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > size {
+			packets = append(packets, packet)
+			packet = nil
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		packets = append(packets, packet)
+	}
+	return packets
+}
@@ -0,0 +1,88 @@
+package statsd
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/config"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+	"github.com/stretchr/testify/require"
+)
+
+func testMetrics() *data.Metrics {
+	return &data.Metrics{
+		Host: &data.Host{Hostname: "docker-1", CPUUsage: 12.5},
+		Container: []*data.ContainerMetrics{
+			{ID: "1", Name: "web.1", Image: "nginx:1,2", State: "running", CPUUsage: 1.5, MemoryUsage: 1024},
+			{ID: "2", Name: "db", State: "exited"},
+		},
+	}
+}
+
+func TestEncodeStatsd(t *testing.T) {
+	s := New(&config.Backend{StatsdPrefix: "dockwizard", StatsdFlavor: "statsd"})
+	lines := s.encode(testMetrics())
+
+	// The stopped container has no stats
+	require.Len(t, lines, len(hostGauges)+len(containerGauges))
+	require.Contains(t, lines, "dockwizard.host.cpu_usage:12.5|g")
+	require.Contains(t, lines, "dockwizard.container.web_1.cpu_usage:1.5|g")
+	require.Contains(t, lines, "dockwizard.container.web_1.memory_usage:1024|g")
+}
+
+func TestEncodeDogStatsd(t *testing.T) {
+	s := New(&config.Backend{StatsdFlavor: "dogstatsd"})
+	lines := s.encode(testMetrics())
+
+	require.Contains(t, lines, "host.cpu_usage:12.5|g|#host:docker-1")
+	require.Contains(t, lines, "container.cpu_usage:1.5|g|#container_id:1,container_name:web.1,image:nginx:1_2,host:docker-1")
+}
+
+func TestEncodeDogStatsdTimestamp(t *testing.T) {
+	s := New(&config.Backend{StatsdFlavor: "dogstatsd"})
+	metrics := testMetrics()
+	metrics.Container[0].Timestamp = time.Unix(1700000000, 0)
+	lines := s.encode(metrics)
+
+	require.Contains(t, lines, "container.cpu_usage:1.5|g|#container_id:1,container_name:web.1,image:nginx:1_2,host:docker-1|T1700000000")
+}
+
+func TestPack(t *testing.T) {
+	lines := []string{"a:1|g", "b:2|g", "c:3|g", strings.Repeat("d", 20)}
+	packets := pack(lines, 12)
+	require.Equal(t, [][]byte{
+		[]byte("a:1|g\nb:2|g"),
+		[]byte("c:3|g"),
+		[]byte(strings.Repeat("d", 20)),
+	}, packets)
+}
+
+func TestSendData(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer conn.Close()
+
+	s := New(&config.Backend{
+		StatsdAddress:       conn.LocalAddr().String(),
+		StatsdPrefix:        "dockwizard",
+		StatsdFlavor:        "dogstatsd",
+		StatsdMaxPacketSize: 512,
+	})
+	metrics := testMetrics()
+	require.Nil(t, s.SendData(context.Background(), metrics))
+
+	expected := len(s.encode(metrics))
+	var received int
+	buf := make([]byte, 65536)
+	for received < expected {
+		require.Nil(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		n, _, err := conn.ReadFrom(buf)
+		require.Nil(t, err)
+		require.LessOrEqual(t, n, 512)
+		received += len(strings.Split(string(buf[:n]), "\n"))
+	}
+	require.Equal(t, expected, received)
+}
@@ -1,6 +1,7 @@
 package stdout
 
 import (
+	"context"
 	"encoding/json"
 	"os"
 
@@ -17,6 +18,6 @@ func New() *stdout {
 	}
 }
 
-func (s *stdout) SendData(metrics *data.Metrics) error {
+func (s *stdout) SendData(_ context.Context, metrics *data.Metrics) error {
 	return json.NewEncoder(s.stdout).Encode(metrics)
 }
@@ -1,6 +1,7 @@
 package stdout
 
 import (
+	"context"
 	"os"
 	"testing"
 
@@ -20,7 +21,7 @@ func TestSendData(t *testing.T) {
 	s := &stdout{
 		stdout: tmp,
 	}
-	s.SendData(&data.Metrics{
+	s.SendData(context.Background(), &data.Metrics{
 		Container: []*data.ContainerMetrics{},
 	})
 
@@ -2,19 +2,241 @@ package config
 
 import (
 	"fmt"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
 
 	"gopkg.in/yaml.v3"
 )
 
-type Container struct{}
+// DefaultConcurrency is the default maximum number of containers
+// to collect stats for at once
+const DefaultConcurrency = 8
+
+// DefaultShutdownTimeout is the default time in seconds the backends
+// get to send buffered data on shutdown
+const DefaultShutdownTimeout = 10
+
+// DefaultAgentIDFile is the name of the file the agent ID is persisted in,
+// next to the config file
+const DefaultAgentIDFile = "agent-id"
+
+// Check is a single health check applied to a container
+type Check struct {
+	// Type is the kind of check to run
+	// Can be "http", "tcp", "exec" or "metric"
+	Type string `yaml:"type"`
+
+	// Port is the container port to connect to
+	// Only used if type is "http" or "tcp"
+	Port int `yaml:"port,omitempty"`
+
+	// Path is the HTTP path to request, defaults to "/"
+	// Only used if type is "http"
+	Path string `yaml:"path,omitempty"`
+
+	// Command is the command to execute inside the container
+	// Only used if type is "exec", a zero exit code is healthy
+	Command []string `yaml:"command,omitempty"`
+
+	// Metric is the metric to compare against the threshold
+	// Can be "cpu" or "memory", only used if type is "metric"
+	Metric string `yaml:"metric,omitempty"`
+
+	// Threshold is the percentage the metric must stay below
+	// Only used if type is "metric"
+	Threshold float64 `yaml:"threshold,omitempty"`
+
+	// Polls is the number of consecutive polls the threshold must be
+	// exceeded for before the check fails, defaults to 1
+	// Only used if type is "metric"
+	Polls int `yaml:"polls,omitempty"`
+
+	// Timeout is the maximum time the check may take
+	// The value is in seconds and may not exceed half the update frequency,
+	// the time collecting a container may take including its checks.
+	// Defaults to 5 seconds or half the update frequency if that is less
+	Timeout int `yaml:"timeout,omitempty"`
+}
+
+// Container selects containers and the health checks to apply to them
+// All selectors that are set must match for a container to be selected
+type Container struct {
+	// Name is a glob matched against the container name
+	Name string `yaml:"name,omitempty"`
+
+	// Regex is a regular expression matched against the container name
+	Regex string `yaml:"regex,omitempty"`
+
+	// Labels are labels the container must have with the given values
+	Labels map[string]string `yaml:"labels,omitempty"`
+
+	// Checks are the health checks to run against matching containers
+	Checks []Check `yaml:"checks"`
+}
+
+// Filter selects containers to include in or exclude from the metrics
+// All selectors that are set must match for a container to match
+type Filter struct {
+	// Name is a glob matched against the container name
+	Name string `yaml:"name,omitempty"`
+
+	// Regex is a regular expression matched against the container name
+	Regex string `yaml:"regex,omitempty"`
+
+	// Image is a glob matched against the container image, e.g. "ghcr.io/acme/*"
+	// A pattern without a tag also matches every tag of the image
+	Image string `yaml:"image,omitempty"`
+
+	// Labels are labels the container must have with the given values
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+// Spool configures where metrics are kept while the backend is unreachable
+type Spool struct {
+	// Directory is the directory the spool segments are stored in
+	// Every network backend spools into a subdirectory named after it
+	// The spool is disabled if empty
+	Directory string `yaml:"directory"`
+
+	// MaxSize is the maximum size of the spool in megabytes, defaults to 100
+	// The oldest batches are dropped once the spool grows past it
+	MaxSize int `yaml:"max_size,omitempty"`
+
+	// MaxAge is the maximum age of a spooled batch, defaults to 24 hours
+	// The value is in seconds
+	MaxAge int `yaml:"max_age,omitempty"`
+}
+
+// Backend is a single destination for the collected metrics
+type Backend struct {
+	// Name identifies the backend in logs and in the spool
+	// Defaults to the type, must be unique
+	Name string `yaml:"name,omitempty"`
+
+	// Type is the kind of backend
+	// Can be "api", "stdout", "prometheus", "otlp", "influxdb", "statsd"
+	// or "file"
+	Type string `yaml:"type"`
+
+	// APIEndpoint is the endpoint to send data to
+	// Only used if type is "api"
+	APIEndpoint string `yaml:"api_endpoint,omitempty"`
+
+	// APIKey is the key to use when sending data to the endpoint
+	// Only used if type is "api"
+	APIKey string `yaml:"api_key,omitempty"`
+
+	// Compression is the content encoding used for the request body
+	// Can be "none", "gzip" or "zstd", defaults to "none"
+	// Only used if type is "api", "otlp" or "influxdb", the latter two do
+	// not support "zstd"
+	Compression string `yaml:"compression,omitempty"`
+
+	// MaxRetries is the number of times a failed request is retried
+	// Only used if type is "api", defaults to 3, -1 disables retries
+	MaxRetries int `yaml:"max_retries,omitempty"`
+
+	// RetryBackoff is the wait before the first retry, doubled for every
+	// following retry. The value is in milliseconds, defaults to 500
+	// Only used if type is "api"
+	RetryBackoff int `yaml:"retry_backoff,omitempty"`
+
+	// RetryMaxBackoff is the longest wait between two retries
+	// The value is in milliseconds, defaults to 10000
+	// Only used if type is "api"
+	RetryMaxBackoff int `yaml:"retry_max_backoff,omitempty"`
+
+	// RetryBudget is the total time a single poll may be retried for, so a
+	// dead endpoint does not pile up work once the next poll is due
+	// The value is in seconds, defaults to the update frequency
+	// Only used if type is "api"
+	RetryBudget int `yaml:"retry_budget,omitempty"`
+
+	// ListenAddress is the address to serve /metrics on
+	// Only used if type is "prometheus", defaults to ":9417"
+	ListenAddress string `yaml:"listen_address,omitempty"`
+
+	// OTLPEndpoint is the URL of the collector's OTLP/HTTP metrics receiver
+	// Only used if type is "otlp", defaults to "http://localhost:4318/v1/metrics"
+	OTLPEndpoint string `yaml:"otlp_endpoint,omitempty"`
+
+	// OTLPEncoding is the encoding of the request body
+	// Can be "protobuf" or "json", defaults to "protobuf"
+	// Only used if type is "otlp"
+	OTLPEncoding string `yaml:"otlp_encoding,omitempty"`
+
+	// Headers are sent with every request, e.g. for authentication
+	// Only used if type is "otlp"
+	Headers map[string]string `yaml:"headers,omitempty"`
+
+	// InfluxURL is where the line protocol is written to
+	// An http or https URL writes to the InfluxDB v2 write API, a
+	// udp://host:port URL sends datagrams and a file:///path URL appends to
+	// the file, e.g. for Telegraf. Defaults to "http://localhost:8086"
+	// Only used if type is "influxdb"
+	InfluxURL string `yaml:"influx_url,omitempty"`
+
+	// InfluxOrg and InfluxBucket are the organization and bucket to write to
+	// Only used if type is "influxdb" with an http or https URL
+	InfluxOrg    string `yaml:"influx_org,omitempty"`
+	InfluxBucket string `yaml:"influx_bucket,omitempty"`
+
+	// InfluxToken is the API token used to authenticate with InfluxDB
+	// Only used if type is "influxdb" with an http or https URL
+	InfluxToken string `yaml:"influx_token,omitempty"`
+
+	// StatsdAddress is the host:port of the StatsD server to send UDP packets to
+	// Only used if type is "statsd", defaults to "localhost:8125"
+	StatsdAddress string `yaml:"statsd_address,omitempty"`
+
+	// StatsdPrefix is prepended to every metric name, separated by a dot
+	// Only used if type is "statsd", defaults to "dockwizard"
+	StatsdPrefix string `yaml:"statsd_prefix,omitempty"`
+
+	// StatsdFlavor is the StatsD dialect to send
+	// Can be "statsd" or "dogstatsd", defaults to "statsd". Plain StatsD has
+	// no tags so the container name is added to the metric name instead
+	// Only used if type is "statsd"
+	StatsdFlavor string `yaml:"statsd_flavor,omitempty"`
+
+	// StatsdMaxPacketSize is the maximum size of a UDP packet in bytes
+	// Metrics are packed into as few packets as fit, defaults to 1432 which
+	// fits an Ethernet MTU. Only used if type is "statsd"
+	StatsdMaxPacketSize int `yaml:"statsd_max_packet_size,omitempty"`
+
+	// FilePath is the file the metrics are appended to as JSON lines
+	// Only used if type is "file"
+	FilePath string `yaml:"file_path,omitempty"`
+
+	// FileMaxSize is the size in megabytes after which the file is rotated
+	// Only used if type is "file", defaults to 100
+	FileMaxSize int `yaml:"file_max_size,omitempty"`
+
+	// FileMaxAge is the age after which the file is rotated
+	// The value is in seconds, defaults to 24 hours
+	// Only used if type is "file"
+	FileMaxAge int `yaml:"file_max_age,omitempty"`
+
+	// FileCompress gzips the rotated files
+	// Only used if type is "file"
+	FileCompress bool `yaml:"file_compress,omitempty"`
+
+	// FileRetention is the number of rotated files to keep, the oldest are
+	// removed first. Defaults to 7, -1 keeps all rotated files
+	// Only used if type is "file"
+	FileRetention int `yaml:"file_retention,omitempty"`
+}
 
 type Config struct {
 	// API Key is the key to use when sending data to the backend
 	APIKey string `yaml:"api_key"`
 
 	// Backend is the endpoint to send data to
-	// Can also be "stdout" to print to stdout
+	// Can also be "stdout" to print to stdout or "prometheus" to expose
+	// the metrics for scraping
 	Backend string `yaml:"backend"`
 
 	// API endpoint is the endpoint to send data to
@@ -25,8 +247,64 @@ type Config struct {
 	// The value is in seconds, minimum 2 seconds
 	UpdateFrequency int `yaml:"update_frequency"`
 
+	// Concurrency is the maximum number of containers to collect stats
+	// for at once, defaults to 8
+	Concurrency int `yaml:"concurrency,omitempty"`
+
+	// PrometheusListenAddress is the address to serve /metrics on
+	// Only used if backend is "prometheus", defaults to ":9417"
+	PrometheusListenAddress string `yaml:"prometheus_listen_address,omitempty"`
+
+	// Backends is a list of backends to send every poll to
+	// Replaces backend, api_key, api_endpoint and prometheus_listen_address
+	// which configure a single backend
+	Backends []Backend `yaml:"backends,omitempty"`
+
+	// Include selects the containers to collect metrics for
+	// A container is collected if it matches any of the filters, all
+	// containers are collected if empty
+	Include []Filter `yaml:"include,omitempty"`
+
+	// Exclude selects containers to leave out even if they are included,
+	// e.g. labels: {dockwizard.ignore: "true"}
+	Exclude []Filter `yaml:"exclude,omitempty"`
+
+	// AllContainers also reports containers that are not running, with their
+	// exit code, the time they stopped and their restart count
+	AllContainers bool `yaml:"all_containers,omitempty"`
+
+	// ContainerLabels are globs of the container label keys to send with
+	// the metrics, e.g. "com.acme.team" or "com.acme.*"
+	// The docker compose and Swarm labels are always sent
+	ContainerLabels []string `yaml:"container_labels,omitempty"`
+
 	// Containers is a list of containers to apply health checks to
 	Containers []Container `yaml:"containers"`
+
+	// ShutdownTimeout is the time the backends get to send buffered data
+	// when the agent stops. The value is in seconds, defaults to 10 seconds
+	ShutdownTimeout int `yaml:"shutdown_timeout,omitempty"`
+
+	// WatchConfig reloads the config when the file changes
+	// The config is always reloaded on SIGHUP
+	WatchConfig bool `yaml:"watch_config,omitempty"`
+
+	// Events streams container lifecycle events (start, die, oom, kill,
+	// restart and health status changes) and sends them with the next poll
+	Events bool `yaml:"events,omitempty"`
+
+	// Spool stores metrics on disk while the backend is unreachable
+	// and replays them in order once it is back
+	Spool Spool `yaml:"spool,omitempty"`
+
+	// AgentIDFile is the file the agent ID is persisted in
+	// Defaults to "agent-id" next to the config file
+	AgentIDFile string `yaml:"agent_id_file,omitempty"`
+
+	// HostRoot is the path the host's root filesystem is mounted at, when the
+	// agent runs in a container. The host metrics are read from /proc, /etc
+	// and the root filesystem below it, defaults to "/"
+	HostRoot string `yaml:"host_root,omitempty"`
 }
 
 func Read(path string) (*Config, error) {
@@ -50,19 +328,336 @@ func Read(path string) (*Config, error) {
 	if cfg.UpdateFrequency < 2 {
 		return nil, fmt.Errorf("update frequency must be at least 2 seconds")
 	}
-	if cfg.Backend == "" {
-		return nil, fmt.Errorf("backend is required, use stdout to print to stdout")
+	if cfg.Concurrency < 0 {
+		return nil, fmt.Errorf("concurrency must not be negative")
+	}
+	if cfg.Concurrency == 0 {
+		cfg.Concurrency = DefaultConcurrency
+	}
+
+	if cfg.ShutdownTimeout < 0 {
+		return nil, fmt.Errorf("shutdown timeout must not be negative")
+	}
+	if cfg.ShutdownTimeout == 0 {
+		cfg.ShutdownTimeout = DefaultShutdownTimeout
+	}
+
+	err = validateBackends(&cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Spool.MaxSize < 0 {
+		return nil, fmt.Errorf("spool max size must not be negative")
+	}
+	if cfg.Spool.MaxAge < 0 {
+		return nil, fmt.Errorf("spool max age must not be negative")
+	}
+	if cfg.Spool.MaxSize == 0 {
+		cfg.Spool.MaxSize = 100
+	}
+	if cfg.Spool.MaxAge == 0 {
+		cfg.Spool.MaxAge = 24 * 60 * 60
+	}
+
+	if cfg.AgentIDFile == "" {
+		cfg.AgentIDFile = filepath.Join(filepath.Dir(path), DefaultAgentIDFile)
+	}
+	if cfg.HostRoot == "" {
+		cfg.HostRoot = "/"
+	}
+
+	for i, f := range cfg.Include {
+		err = validateFilter(f)
+		if err != nil {
+			return nil, fmt.Errorf("include[%d]: %w", i, err)
+		}
+	}
+	for i, f := range cfg.Exclude {
+		err = validateFilter(f)
+		if err != nil {
+			return nil, fmt.Errorf("exclude[%d]: %w", i, err)
+		}
 	}
 
-	// Verify that API endpoint and API key are set if backend is "api"
-	if cfg.Backend == "api" {
-		if cfg.APIEndpoint == "" {
-			return nil, fmt.Errorf("api endpoint is required when backend is api")
+	for i, glob := range cfg.ContainerLabels {
+		err = validateGlob(glob)
+		if err != nil {
+			return nil, fmt.Errorf("container_labels[%d]: %w", i, err)
 		}
-		if cfg.APIKey == "" {
-			return nil, fmt.Errorf("api key is required when backend is api")
+	}
+
+	for i, c := range cfg.Containers {
+		err = validateContainer(c, cfg.UpdateFrequency/2)
+		if err != nil {
+			return nil, fmt.Errorf("containers[%d]: %w", i, err)
 		}
 	}
 
 	return &cfg, nil
 }
+
+// validateBackends validates the backends and fills in their defaults
+// A single backend configured with the top level fields is turned into a
+// one element list so the rest of the agent only has to look at Backends
+func validateBackends(cfg *Config) error {
+	if len(cfg.Backends) == 0 {
+		if cfg.Backend == "" {
+			return fmt.Errorf("backend is required, use stdout to print to stdout")
+		}
+
+		cfg.Backends = []Backend{
+			{
+				Type:          cfg.Backend,
+				APIEndpoint:   cfg.APIEndpoint,
+				APIKey:        cfg.APIKey,
+				ListenAddress: cfg.PrometheusListenAddress,
+			},
+		}
+		return validateBackend(&cfg.Backends[0], cfg)
+	}
+
+	if cfg.Backend != "" {
+		return fmt.Errorf("backend and backends can not be used together")
+	}
+
+	names := map[string]bool{}
+	for i := range cfg.Backends {
+		b := &cfg.Backends[i]
+		err := validateBackend(b, cfg)
+		if err != nil {
+			return fmt.Errorf("backends[%d]: %w", i, err)
+		}
+
+		if names[b.Name] {
+			return fmt.Errorf("backends[%d]: duplicate backend name %q", i, b.Name)
+		}
+		names[b.Name] = true
+	}
+
+	return nil
+}
+
+func validateBackend(b *Backend, cfg *Config) error {
+	if b.Name == "" {
+		b.Name = b.Type
+	}
+
+	switch b.Type {
+	case "stdout":
+	case "api":
+		// Verify that API endpoint and API key are set if backend is "api"
+		if b.APIEndpoint == "" {
+			return fmt.Errorf("api endpoint is required when backend is api")
+		}
+		if b.APIKey == "" {
+			return fmt.Errorf("api key is required when backend is api")
+		}
+
+		switch b.Compression {
+		case "", "none", "gzip", "zstd":
+		default:
+			return fmt.Errorf("compression must be none, gzip or zstd")
+		}
+
+		if b.MaxRetries < -1 {
+			return fmt.Errorf("max retries must be -1 or more")
+		}
+		if b.RetryBackoff < 0 || b.RetryMaxBackoff < 0 || b.RetryBudget < 0 {
+			return fmt.Errorf("retry backoff and budget must not be negative")
+		}
+		if b.MaxRetries == 0 {
+			b.MaxRetries = 3
+		}
+		if b.RetryBackoff == 0 {
+			b.RetryBackoff = 500
+		}
+		if b.RetryMaxBackoff == 0 {
+			b.RetryMaxBackoff = 10000
+		}
+		if b.RetryBudget == 0 {
+			b.RetryBudget = cfg.UpdateFrequency
+		}
+	case "prometheus":
+		if b.ListenAddress == "" {
+			b.ListenAddress = ":9417"
+		}
+	case "otlp":
+		if b.OTLPEndpoint == "" {
+			b.OTLPEndpoint = "http://localhost:4318/v1/metrics"
+		}
+		switch b.OTLPEncoding {
+		case "":
+			b.OTLPEncoding = "protobuf"
+		case "protobuf", "json":
+		default:
+			return fmt.Errorf("otlp encoding must be protobuf or json")
+		}
+		switch b.Compression {
+		case "", "none", "gzip":
+		default:
+			return fmt.Errorf("compression must be none or gzip")
+		}
+	case "influxdb":
+		if b.InfluxURL == "" {
+			b.InfluxURL = "http://localhost:8086"
+		}
+		u, err := url.Parse(b.InfluxURL)
+		if err != nil {
+			return fmt.Errorf("invalid influx url: %w", err)
+		}
+		switch u.Scheme {
+		case "http", "https":
+			if b.InfluxOrg == "" || b.InfluxBucket == "" {
+				return fmt.Errorf("influx org and bucket are required for an http url")
+			}
+		case "udp":
+			if u.Host == "" {
+				return fmt.Errorf("influx url must be udp://host:port")
+			}
+		case "file":
+			if u.Path == "" {
+				return fmt.Errorf("influx url must be file:///path")
+			}
+		default:
+			return fmt.Errorf("influx url must be an http, https, udp or file url")
+		}
+		switch b.Compression {
+		case "", "none", "gzip":
+		default:
+			return fmt.Errorf("compression must be none or gzip")
+		}
+	case "statsd":
+		if b.StatsdAddress == "" {
+			b.StatsdAddress = "localhost:8125"
+		}
+		if b.StatsdPrefix == "" {
+			b.StatsdPrefix = "dockwizard"
+		}
+		switch b.StatsdFlavor {
+		case "":
+			b.StatsdFlavor = "statsd"
+		case "statsd", "dogstatsd":
+		default:
+			return fmt.Errorf("statsd flavor must be statsd or dogstatsd")
+		}
+		if b.StatsdMaxPacketSize < 0 {
+			return fmt.Errorf("statsd max packet size must not be negative")
+		}
+		if b.StatsdMaxPacketSize == 0 {
+			b.StatsdMaxPacketSize = 1432
+		}
+	case "file":
+		if b.FilePath == "" {
+			return fmt.Errorf("file path is required when backend is file")
+		}
+		if b.FileMaxSize < 0 || b.FileMaxAge < 0 {
+			return fmt.Errorf("file max size and age must not be negative")
+		}
+		if b.FileRetention < -1 {
+			return fmt.Errorf("file retention must be -1 or more")
+		}
+		if b.FileMaxSize == 0 {
+			b.FileMaxSize = 100
+		}
+		if b.FileMaxAge == 0 {
+			b.FileMaxAge = 24 * 60 * 60
+		}
+		if b.FileRetention == 0 {
+			b.FileRetention = 7
+		}
+	case "":
+		return fmt.Errorf("backend type is required")
+	default:
+		return fmt.Errorf("unknown backend type %q", b.Type)
+	}
+
+	return nil
+}
+
+func validateGlob(glob string) error {
+	_, err := path.Match(glob, "")
+	if err != nil {
+		return fmt.Errorf("invalid glob %q: %w", glob, err)
+	}
+	return nil
+}
+
+func validateFilter(f Filter) error {
+	if f.Name == "" && f.Regex == "" && f.Image == "" && len(f.Labels) == 0 {
+		return fmt.Errorf("one of name, regex, image or labels is required")
+	}
+	for _, glob := range []string{f.Name, f.Image} {
+		err := validateGlob(glob)
+		if err != nil {
+			return err
+		}
+	}
+	if f.Regex != "" {
+		_, err := regexp.Compile(f.Regex)
+		if err != nil {
+			return fmt.Errorf("invalid regex: %w", err)
+		}
+	}
+	return nil
+}
+
+func validateContainer(c Container, maxTimeout int) error {
+	if c.Name == "" && c.Regex == "" && len(c.Labels) == 0 {
+		return fmt.Errorf("one of name, regex or labels is required")
+	}
+	if c.Regex != "" {
+		_, err := regexp.Compile(c.Regex)
+		if err != nil {
+			return fmt.Errorf("invalid regex: %w", err)
+		}
+	}
+	if len(c.Checks) == 0 {
+		return fmt.Errorf("at least one check is required")
+	}
+
+	for i, check := range c.Checks {
+		err := validateCheck(check, maxTimeout)
+		if err != nil {
+			return fmt.Errorf("checks[%d]: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// validateCheck validates the check, its timeout may be at most maxTimeout
+// seconds
+func validateCheck(c Check, maxTimeout int) error {
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	if c.Timeout > maxTimeout {
+		return fmt.Errorf("timeout must not exceed %ds, half the update frequency", maxTimeout)
+	}
+
+	switch c.Type {
+	case "http", "tcp":
+		if c.Port <= 0 || c.Port > 65535 {
+			return fmt.Errorf("a valid port is required when type is %s", c.Type)
+		}
+	case "exec":
+		if len(c.Command) == 0 {
+			return fmt.Errorf("command is required when type is exec")
+		}
+	case "metric":
+		if c.Metric != "cpu" && c.Metric != "memory" {
+			return fmt.Errorf("metric must be cpu or memory")
+		}
+		if c.Threshold <= 0 {
+			return fmt.Errorf("threshold must be greater than 0")
+		}
+		if c.Polls < 0 {
+			return fmt.Errorf("polls must not be negative")
+		}
+	default:
+		return fmt.Errorf("unknown check type %q", c.Type)
+	}
+
+	return nil
+}
@@ -2,6 +2,7 @@ package config_test
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/dockwizard/dockwizard_agent/agent/pkg/config"
@@ -125,3 +126,437 @@ containers: []
 	_, err = config.Read(tmp.Name())
 	require.Errorf(t, err, "api key is required when backend is api")
 }
+
+func TestReadContainers(t *testing.T) {
+	in := `---
+backend: stdout
+update_frequency: 2
+containers:
+  - name: web*
+    labels:
+      team: a
+    checks:
+      - type: http
+        port: 8080
+        path: /health
+      - type: metric
+        metric: cpu
+        threshold: 90
+        polls: 3
+`
+
+	tmp, err := os.CreateTemp("", "")
+	require.Nil(t, err)
+	_, err = tmp.Write([]byte(in))
+	require.Nil(t, err)
+
+	c, err := config.Read(tmp.Name())
+	require.Nil(t, err)
+	require.Equal(t, 1, len(c.Containers))
+	require.Equal(t, "web*", c.Containers[0].Name)
+	require.Equal(t, "a", c.Containers[0].Labels["team"])
+	require.Equal(t, 2, len(c.Containers[0].Checks))
+	require.Equal(t, 8080, c.Containers[0].Checks[0].Port)
+	require.Equal(t, 3, c.Containers[0].Checks[1].Polls)
+}
+
+func TestReadContainersInvalid(t *testing.T) {
+	tests := map[string]string{
+		"containers[0]: one of name, regex or labels is required": `
+containers:
+  - checks:
+      - type: tcp
+        port: 80
+`,
+		"containers[0]: at least one check is required": `
+containers:
+  - name: web
+`,
+		"containers[0]: checks[0]: a valid port is required when type is http": `
+containers:
+  - name: web
+    checks:
+      - type: http
+`,
+		"containers[0]: checks[0]: command is required when type is exec": `
+containers:
+  - name: web
+    checks:
+      - type: exec
+`,
+		"containers[0]: checks[0]: metric must be cpu or memory": `
+containers:
+  - name: web
+    checks:
+      - type: metric
+        threshold: 10
+`,
+		"containers[0]: checks[0]: timeout must not exceed 1s, half the update frequency": `
+containers:
+  - name: web
+    checks:
+      - type: tcp
+        port: 80
+        timeout: 5
+`,
+		`containers[0]: checks[0]: unknown check type "ping"`: `
+containers:
+  - name: web
+    checks:
+      - type: ping
+`,
+	}
+
+	for expected, containers := range tests {
+		tmp, err := os.CreateTemp("", "")
+		require.Nil(t, err)
+		_, err = tmp.Write([]byte("backend: stdout\nupdate_frequency: 2\n" + containers))
+		require.Nil(t, err)
+
+		_, err = config.Read(tmp.Name())
+		require.EqualError(t, err, expected)
+	}
+}
+
+func TestReadSpoolDefaults(t *testing.T) {
+	in := `---
+backend: stdout
+update_frequency: 2
+spool:
+  directory: /var/lib/dockwizard/spool
+`
+
+	tmp, err := os.CreateTemp("", "")
+	require.Nil(t, err)
+	_, err = tmp.Write([]byte(in))
+	require.Nil(t, err)
+
+	c, err := config.Read(tmp.Name())
+	require.Nil(t, err)
+	require.Equal(t, "/var/lib/dockwizard/spool", c.Spool.Directory)
+	require.Equal(t, 100, c.Spool.MaxSize)
+	require.Equal(t, 86400, c.Spool.MaxAge)
+}
+
+func TestReadPrometheusDefaults(t *testing.T) {
+	in := `---
+backend: prometheus
+update_frequency: 2
+`
+
+	tmp, err := os.CreateTemp("", "")
+	require.Nil(t, err)
+	_, err = tmp.Write([]byte(in))
+	require.Nil(t, err)
+
+	c, err := config.Read(tmp.Name())
+	require.Nil(t, err)
+	require.Equal(t, ":9417", c.Backends[0].ListenAddress)
+}
+
+func TestReadOTLPDefaults(t *testing.T) {
+	in := `---
+backend: otlp
+update_frequency: 2
+`
+
+	tmp, err := os.CreateTemp("", "")
+	require.Nil(t, err)
+	_, err = tmp.Write([]byte(in))
+	require.Nil(t, err)
+
+	c, err := config.Read(tmp.Name())
+	require.Nil(t, err)
+	require.Equal(t, "http://localhost:4318/v1/metrics", c.Backends[0].OTLPEndpoint)
+	require.Equal(t, "protobuf", c.Backends[0].OTLPEncoding)
+}
+
+func TestReadInfluxDB(t *testing.T) {
+	in := `---
+update_frequency: 2
+backends:
+  - type: influxdb
+    influx_org: example
+    influx_bucket: docker
+    influx_token: 123
+  - name: telegraf
+    type: influxdb
+    influx_url: udp://localhost:8089
+`
+
+	tmp, err := os.CreateTemp("", "")
+	require.Nil(t, err)
+	_, err = tmp.Write([]byte(in))
+	require.Nil(t, err)
+
+	c, err := config.Read(tmp.Name())
+	require.Nil(t, err)
+	require.Equal(t, "http://localhost:8086", c.Backends[0].InfluxURL)
+	require.Equal(t, "123", c.Backends[0].InfluxToken)
+	require.Equal(t, "udp://localhost:8089", c.Backends[1].InfluxURL)
+}
+
+func TestReadStatsdDefaults(t *testing.T) {
+	in := `---
+backend: statsd
+update_frequency: 2
+`
+
+	tmp, err := os.CreateTemp("", "")
+	require.Nil(t, err)
+	_, err = tmp.Write([]byte(in))
+	require.Nil(t, err)
+
+	c, err := config.Read(tmp.Name())
+	require.Nil(t, err)
+	require.Equal(t, "localhost:8125", c.Backends[0].StatsdAddress)
+	require.Equal(t, "dockwizard", c.Backends[0].StatsdPrefix)
+	require.Equal(t, "statsd", c.Backends[0].StatsdFlavor)
+	require.Equal(t, 1432, c.Backends[0].StatsdMaxPacketSize)
+}
+
+func TestReadFileDefaults(t *testing.T) {
+	in := `---
+update_frequency: 2
+backends:
+  - type: file
+    file_path: /var/log/dockwizard/metrics.jsonl
+`
+
+	tmp, err := os.CreateTemp("", "")
+	require.Nil(t, err)
+	_, err = tmp.Write([]byte(in))
+	require.Nil(t, err)
+
+	c, err := config.Read(tmp.Name())
+	require.Nil(t, err)
+	require.Equal(t, 100, c.Backends[0].FileMaxSize)
+	require.Equal(t, 86400, c.Backends[0].FileMaxAge)
+	require.Equal(t, 7, c.Backends[0].FileRetention)
+}
+
+func TestReadHostDefaults(t *testing.T) {
+	in := `---
+backend: stdout
+update_frequency: 2
+`
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dockwizard.yaml")
+	require.Nil(t, os.WriteFile(path, []byte(in), 0644))
+
+	c, err := config.Read(path)
+	require.Nil(t, err)
+	require.Equal(t, filepath.Join(dir, "agent-id"), c.AgentIDFile)
+	require.Equal(t, "/", c.HostRoot)
+}
+
+func TestReadBackends(t *testing.T) {
+	in := `---
+update_frequency: 2
+backends:
+  - type: api
+    api_endpoint: http://localhost:8080
+    api_key: 123
+  - type: stdout
+  - name: local
+    type: prometheus
+`
+
+	tmp, err := os.CreateTemp("", "")
+	require.Nil(t, err)
+	_, err = tmp.Write([]byte(in))
+	require.Nil(t, err)
+
+	c, err := config.Read(tmp.Name())
+	require.Nil(t, err)
+	require.Equal(t, 3, len(c.Backends))
+	require.Equal(t, "api", c.Backends[0].Name)
+	require.Equal(t, "123", c.Backends[0].APIKey)
+	require.Equal(t, "stdout", c.Backends[1].Name)
+	require.Equal(t, "local", c.Backends[2].Name)
+	require.Equal(t, ":9417", c.Backends[2].ListenAddress)
+}
+
+func TestReadSingleBackend(t *testing.T) {
+	in := `---
+backend: api
+api_endpoint: http://localhost:8080
+api_key: 123
+update_frequency: 2
+`
+
+	tmp, err := os.CreateTemp("", "")
+	require.Nil(t, err)
+	_, err = tmp.Write([]byte(in))
+	require.Nil(t, err)
+
+	c, err := config.Read(tmp.Name())
+	require.Nil(t, err)
+	require.Equal(t, []config.Backend{
+		{
+			Name:            "api",
+			Type:            "api",
+			APIEndpoint:     "http://localhost:8080",
+			APIKey:          "123",
+			MaxRetries:      3,
+			RetryBackoff:    500,
+			RetryMaxBackoff: 10000,
+			RetryBudget:     2,
+		},
+	}, c.Backends)
+}
+
+func TestReadAPICompression(t *testing.T) {
+	for _, compression := range []string{"none", "gzip", "zstd"} {
+		in := `---
+update_frequency: 2
+backends:
+  - type: api
+    api_endpoint: http://localhost:8080
+    api_key: 123
+    compression: ` + compression + "\n"
+
+		tmp, err := os.CreateTemp("", "")
+		require.Nil(t, err)
+		_, err = tmp.Write([]byte(in))
+		require.Nil(t, err)
+
+		c, err := config.Read(tmp.Name())
+		require.Nil(t, err)
+		require.Equal(t, compression, c.Backends[0].Compression)
+	}
+}
+
+func TestReadBackendsInvalid(t *testing.T) {
+	tests := map[string]string{
+		"backend and backends can not be used together": `
+backend: stdout
+backends:
+  - type: stdout
+`,
+		"backends[1]: duplicate backend name \"stdout\"": `
+backends:
+  - type: stdout
+  - type: stdout
+`,
+		"backends[0]: api key is required when backend is api": `
+backends:
+  - type: api
+    api_endpoint: http://localhost:8080
+`,
+		"backends[0]: compression must be none, gzip or zstd": `
+backends:
+  - type: api
+    api_endpoint: http://localhost:8080
+    api_key: 123
+    compression: brotli
+`,
+		"backends[0]: unknown backend type \"kafka\"": `
+backends:
+  - type: kafka
+`,
+		"unknown backend type \"kafka\"": `
+backend: kafka
+`,
+		"backends[0]: otlp encoding must be protobuf or json": `
+backends:
+  - type: otlp
+    otlp_encoding: xml
+`,
+		"backends[0]: compression must be none or gzip": `
+backends:
+  - type: otlp
+    compression: zstd
+`,
+		"backends[0]: influx org and bucket are required for an http url": `
+backends:
+  - type: influxdb
+    influx_bucket: docker
+`,
+		"backends[0]: influx url must be an http, https, udp or file url": `
+backends:
+  - type: influxdb
+    influx_url: tcp://localhost:8089
+`,
+		"backends[0]: statsd flavor must be statsd or dogstatsd": `
+backends:
+  - type: statsd
+    statsd_flavor: graphite
+`,
+		"backends[0]: file path is required when backend is file": `
+backends:
+  - type: file
+`,
+		"backends[0]: file retention must be -1 or more": `
+backends:
+  - type: file
+    file_path: metrics.jsonl
+    file_retention: -2
+`,
+	}
+
+	for expected, backends := range tests {
+		tmp, err := os.CreateTemp("", "")
+		require.Nil(t, err)
+		_, err = tmp.Write([]byte("update_frequency: 2\n" + backends))
+		require.Nil(t, err)
+
+		_, err = config.Read(tmp.Name())
+		require.EqualError(t, err, expected)
+	}
+}
+
+func TestReadFilters(t *testing.T) {
+	in := `---
+backend: stdout
+update_frequency: 2
+include:
+  - image: ghcr.io/acme/*
+exclude:
+  - labels:
+      dockwizard.ignore: "true"
+`
+
+	tmp, err := os.CreateTemp("", "")
+	require.Nil(t, err)
+	_, err = tmp.Write([]byte(in))
+	require.Nil(t, err)
+
+	c, err := config.Read(tmp.Name())
+	require.Nil(t, err)
+	require.Equal(t, []config.Filter{{Image: "ghcr.io/acme/*"}}, c.Include)
+	require.Equal(t, []config.Filter{{Labels: map[string]string{"dockwizard.ignore": "true"}}}, c.Exclude)
+}
+
+func TestReadFiltersInvalid(t *testing.T) {
+	tests := map[string]string{
+		"include[0]: one of name, regex, image or labels is required": `
+include:
+  - {}
+`,
+		`exclude[0]: invalid glob "web-[": syntax error in pattern`: `
+exclude:
+  - name: web-[
+`,
+		`container_labels[0]: invalid glob "com.acme.[": syntax error in pattern`: `
+container_labels:
+  - com.acme.[
+`,
+		"exclude[1]: invalid regex: error parsing regexp: missing closing ): `(ci`": `
+exclude:
+  - name: web
+  - regex: (ci
+`,
+	}
+
+	for expected, filters := range tests {
+		tmp, err := os.CreateTemp("", "")
+		require.Nil(t, err)
+		_, err = tmp.Write([]byte("backend: stdout\nupdate_frequency: 2\n" + filters))
+		require.Nil(t, err)
+
+		_, err = config.Read(tmp.Name())
+		require.EqualError(t, err, expected)
+	}
+}
@@ -1,5 +1,7 @@
 package data
 
+import "time"
+
 type ContainerMetrics struct {
 	// ID is the container ID
 	ID string `json:"id"`
@@ -10,9 +12,51 @@ type ContainerMetrics struct {
 	// Image is the container image
 	Image string `json:"image"`
 
+	// Timestamp is the time the stats were read by the Docker daemon
+	// For containers without stats it is the time they were collected
+	Timestamp time.Time `json:"timestamp"`
+
+	// PreRead is the time of the previous read the CPU usage was computed
+	// against. Only set if the daemon reported one
+	PreRead *time.Time `json:"preread,omitempty"`
+
 	// CPUUsage is the CPU usage in percentage
 	CPUUsage float64 `json:"cpu_usage"`
 
+	// CPUUserPercentage and CPUSystemPercentage split the CPU usage into the
+	// time spent in user and in kernel mode
+	CPUUserPercentage   float64 `json:"cpu_user_percentage"`
+	CPUSystemPercentage float64 `json:"cpu_system_percentage"`
+
+	// PerCPUUsage is the CPU usage on every CPU in percentage of that CPU
+	// Only reported on cgroup v1 hosts
+	PerCPUUsage []float64 `json:"per_cpu_usage,omitempty"`
+
+	// CPULimit is the number of CPUs the container may use, e.g. 1.5
+	// Zero if the container is not limited
+	CPULimit float64 `json:"cpu_limit,omitempty"`
+
+	// CPUPeriods is the number of CPU enforcement periods that elapsed
+	// Only counted for containers with a CPU limit
+	CPUPeriods int `json:"cpu_periods"`
+
+	// CPUThrottledPeriods is the number of periods the container was
+	// throttled in because it used up its CPU limit
+	CPUThrottledPeriods int `json:"cpu_throttled_periods"`
+
+	// CPUThrottledTime is the total time the container was throttled in nanoseconds
+	CPUThrottledTime int `json:"cpu_throttled_time"`
+
+	// CPUThrottledPercentage is the percentage of periods the container
+	// was throttled in since it started
+	CPUThrottledPercentage float64 `json:"cpu_throttled_percentage"`
+
+	// PIDs is the number of processes in the container
+	PIDs int `json:"pids"`
+
+	// PIDsLimit is the maximum number of processes, zero if unlimited
+	PIDsLimit int `json:"pids_limit,omitempty"`
+
 	// MemoryUsage is the memory usage in MB
 	MemoryUsage int `json:"memory_usage"`
 
@@ -22,6 +66,40 @@ type ContainerMetrics struct {
 	// State is the container state
 	State string `json:"state"`
 
+	// HealthStatus is the status of the container's Docker health check
+	// One of "starting", "healthy" or "unhealthy", empty if it has none
+	HealthStatus string `json:"health_status,omitempty"`
+
+	// Labels are the container labels matching the configured allow-list
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// ComposeProject and ComposeService are the docker compose project and
+	// service the container belongs to
+	ComposeProject string `json:"compose_project,omitempty"`
+	ComposeService string `json:"compose_service,omitempty"`
+
+	// SwarmService and SwarmStack are the Swarm service and stack the
+	// container belongs to
+	SwarmService string `json:"swarm_service,omitempty"`
+	SwarmStack   string `json:"swarm_stack,omitempty"`
+
+	// ImageID is the ID of the image the container runs
+	ImageID string `json:"image_id,omitempty"`
+
+	// ImageDigest is the repository digest of the image, e.g. "sha256:..."
+	// Empty for images that were never pushed or pulled
+	ImageDigest string `json:"image_digest,omitempty"`
+
+	// Created is the time the container was created
+	Created *time.Time `json:"created,omitempty"`
+
+	// StartedAt is the time the container was last started
+	StartedAt *time.Time `json:"started_at,omitempty"`
+
+	// RestartPolicy is the restart policy of the container, e.g. "always"
+	// or "on-failure:5"
+	RestartPolicy string `json:"restart_policy,omitempty"`
+
 	// NetworkIORead is the network IO read in bytes
 	NetworkIORead int `json:"network_io_read"`
 
@@ -33,8 +111,196 @@ type ContainerMetrics struct {
 
 	// BlockIOWrite is the block IO write in bytes
 	BlockIOWrite int `json:"block_io_write"`
+
+	// Rates are the per second rates since the previous sample of the container
+	// Not set for the first sample or if the counters were reset
+	Rates *ContainerRates `json:"rates,omitempty"`
+
+	// CounterReset is true if the counters went backwards since the previous
+	// sample, which happens when the container restarted
+	CounterReset bool `json:"counter_reset,omitempty"`
+
+	// Error is set if the container's stats could not be collected
+	// The usage fields are zero in that case
+	Error string `json:"error,omitempty"`
+
+	// HealthChecks are the results of the health checks configured for the container
+	HealthChecks []*HealthCheckResult `json:"health_checks,omitempty"`
+
+	// ExitCode is the exit code of the last run of the container
+	// Only set for containers that exited or are dead
+	ExitCode *int `json:"exit_code,omitempty"`
+
+	// FinishedAt is the time the container last stopped
+	// Only set for containers that exited or are dead
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	// RestartCount is the number of times the container was restarted by
+	// its restart policy. Only set for containers that are not running
+	RestartCount int `json:"restart_count,omitempty"`
+}
+
+// Running returns true if the container has processes to collect stats for
+func (c *ContainerMetrics) Running() bool {
+	return c.State == "running" || c.State == "paused"
+}
+
+// HasStats returns true if the usage fields hold the stats of the container
+// They are zero for containers that are not running or whose stats could
+// not be collected
+func (c *ContainerMetrics) HasStats() bool {
+	return c.Running() && c.Error == ""
+}
+
+type ContainerRates struct {
+	// Interval is the time between the two samples in seconds
+	Interval float64 `json:"interval"`
+
+	// NetworkRxBytes is the network bytes received per second
+	NetworkRxBytes float64 `json:"network_rx_bytes"`
+
+	// NetworkTxBytes is the network bytes sent per second
+	NetworkTxBytes float64 `json:"network_tx_bytes"`
+
+	// NetworkRxPackets is the network packets received per second
+	NetworkRxPackets float64 `json:"network_rx_packets"`
+
+	// NetworkTxPackets is the network packets sent per second
+	NetworkTxPackets float64 `json:"network_tx_packets"`
+
+	// BlockIORead is the block IO bytes read per second
+	BlockIORead float64 `json:"block_io_read"`
+
+	// BlockIOWrite is the block IO bytes written per second
+	BlockIOWrite float64 `json:"block_io_write"`
+
+	// CPUThrottledPercentage is the percentage of CPU periods the
+	// container was throttled in during the interval
+	CPUThrottledPercentage float64 `json:"cpu_throttled_percentage"`
+
+	// CPUThrottledTime is the time the container was throttled in seconds per second
+	CPUThrottledTime float64 `json:"cpu_throttled_time"`
+}
+
+type HealthCheckResult struct {
+	// Type is the kind of check that was run
+	Type string `json:"type"`
+
+	// Target describes what was checked, e.g. the URL or command
+	Target string `json:"target"`
+
+	// Healthy is true if the check passed
+	Healthy bool `json:"healthy"`
+
+	// Message describes why the check failed
+	Message string `json:"message,omitempty"`
+}
+
+type ContainerEvent struct {
+	// ID is the container ID
+	ID string `json:"id"`
+
+	// Name is the container name
+	Name string `json:"name"`
+
+	// Image is the container image
+	Image string `json:"image"`
+
+	// Action is the lifecycle transition
+	// One of "start", "die", "oom", "kill", "restart" or "health_status"
+	Action string `json:"action"`
+
+	// ExitCode is the exit code of the container, only set for "die"
+	ExitCode *int `json:"exit_code,omitempty"`
+
+	// Signal is the signal sent to the container, only set for "kill"
+	Signal string `json:"signal,omitempty"`
+
+	// HealthStatus is the new health status, only set for "health_status"
+	HealthStatus string `json:"health_status,omitempty"`
+
+	// Timestamp is the time the event happened
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type Host struct {
+	// AgentID is the stable ID of the agent, persisted next to the config
+	AgentID string `json:"agent_id"`
+
+	// Hostname is the name of the host the agent runs on
+	Hostname string `json:"hostname"`
+
+	// OS is the name of the host operating system, e.g. "Debian GNU/Linux 12 (bookworm)"
+	OS string `json:"os"`
+
+	// Kernel is the kernel release of the host
+	Kernel string `json:"kernel"`
+
+	// DockerVersion is the version of the Docker engine
+	DockerVersion string `json:"docker_version"`
+
+	// Timestamp is the time the host metrics were collected
+	Timestamp time.Time `json:"timestamp"`
+
+	// CPUs is the number of CPUs of the host
+	CPUs int `json:"cpus"`
+
+	// CPUUsage is the CPU usage of the host in percentage since the previous sample
+	// Zero for the first sample
+	CPUUsage float64 `json:"cpu_usage"`
+
+	// MemoryTotal is the total memory of the host in bytes
+	MemoryTotal int `json:"memory_total"`
+
+	// MemoryUsage is the memory used by the host in bytes, not counting
+	// memory the kernel can reclaim
+	MemoryUsage int `json:"memory_usage"`
+
+	// MemoryUsagePercentage is the memory usage in percentage
+	MemoryUsagePercentage float64 `json:"memory_usage_percentage"`
+
+	// Load1, Load5 and Load15 are the load averages over 1, 5 and 15 minutes
+	Load1  float64 `json:"load1"`
+	Load5  float64 `json:"load5"`
+	Load15 float64 `json:"load15"`
+
+	// DiskTotal is the size of the root filesystem in bytes
+	DiskTotal int `json:"disk_total"`
+
+	// DiskUsage is the space used on the root filesystem in bytes
+	DiskUsage int `json:"disk_usage"`
+
+	// DiskUsagePercentage is the disk usage in percentage as reported by df,
+	// space reserved for root is not counted as available
+	DiskUsagePercentage float64 `json:"disk_usage_percentage"`
+
+	// Error is set if some of the host metrics could not be collected
+	// The fields that could not be read are zero in that case
+	Error string `json:"error,omitempty"`
 }
 
 type Metrics struct {
+	// Host describes the machine the metrics were collected on
+	Host *Host `json:",omitempty"`
+
 	Container []*ContainerMetrics
+
+	// Events are the container lifecycle events since the previous poll
+	Events []*ContainerEvent `json:",omitempty"`
+}
+
+// Collected returns when the metrics were collected, the host timestamp or
+// else the earliest container timestamp. Zero if none of them is set
+func (m *Metrics) Collected() time.Time {
+	if m.Host != nil && !m.Host.Timestamp.IsZero() {
+		return m.Host.Timestamp
+	}
+
+	var ret time.Time
+	for _, c := range m.Container {
+		if !c.Timestamp.IsZero() && (ret.IsZero() || c.Timestamp.Before(ret)) {
+			ret = c.Timestamp
+		}
+	}
+	return ret
 }
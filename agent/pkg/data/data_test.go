@@ -1 +1,25 @@
 package data_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollected(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	first := now.Add(-20 * time.Second)
+	second := now.Add(-10 * time.Second)
+
+	require.True(t, (&data.Metrics{}).Collected().IsZero())
+	require.Equal(t, first, (&data.Metrics{
+		Host:      &data.Host{},
+		Container: []*data.ContainerMetrics{{Timestamp: second}, {}, {Timestamp: first}},
+	}).Collected())
+	require.Equal(t, second, (&data.Metrics{
+		Host:      &data.Host{Timestamp: second},
+		Container: []*data.ContainerMetrics{{Timestamp: first}},
+	}).Collected())
+}
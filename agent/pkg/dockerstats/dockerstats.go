@@ -2,6 +2,7 @@ package dockerstats
 
 import (
 	"encoding/json"
+	"math"
 	"time"
 
 	"github.com/docker/docker/api/types"
@@ -9,15 +10,22 @@ import (
 
 type DockerStats struct {
 	Read        time.Time          `json:"read,omitempty"`
+	PreRead     time.Time          `json:"preread,omitempty"`
 	PidsStats   PidsStats          `json:"pids_stats,omitempty"`
 	Networks    map[string]Network `json:"networks,omitempty"`
 	MemoryStats MemoryStats        `json:"memory_stats,omitempty"`
 	BlkioStats  types.BlkioStats   `json:"blkio_stats,omitempty"`
 	CPUStats    CPUStats           `json:"cpu_stats,omitempty"`
 	PrecpuStats PrecpuStats        `json:"precpu_stats,omitempty"`
+
+	// cgroupV1 is true if the stats come from a cgroup v1 host
+	cgroupV1 bool
 }
 type PidsStats struct {
 	Current int `json:"current,omitempty"`
+	// Limit is a float since docker reports no limit as the largest uint64,
+	// which some versions print rounded up past it
+	Limit float64 `json:"limit,omitempty"`
 }
 type Network struct {
 	RxBytes   int `json:"rx_bytes,omitempty"`
@@ -59,6 +67,32 @@ type Stats struct {
 	Pgfault                 int `json:"pgfault,omitempty"`
 	InactiveFile            int `json:"inactive_file,omitempty"`
 	TotalPgpgin             int `json:"total_pgpgin,omitempty"`
+
+	// cgroup v2 only fields
+	Anon                  int `json:"anon,omitempty"`
+	AnonThp               int `json:"anon_thp,omitempty"`
+	File                  int `json:"file,omitempty"`
+	FileDirty             int `json:"file_dirty,omitempty"`
+	FileMapped            int `json:"file_mapped,omitempty"`
+	FileWriteback         int `json:"file_writeback,omitempty"`
+	KernelStack           int `json:"kernel_stack,omitempty"`
+	Pgactivate            int `json:"pgactivate,omitempty"`
+	Pgdeactivate          int `json:"pgdeactivate,omitempty"`
+	Pglazyfree            int `json:"pglazyfree,omitempty"`
+	Pglazyfreed           int `json:"pglazyfreed,omitempty"`
+	Pgrefill              int `json:"pgrefill,omitempty"`
+	Pgscan                int `json:"pgscan,omitempty"`
+	Pgsteal               int `json:"pgsteal,omitempty"`
+	Shmem                 int `json:"shmem,omitempty"`
+	Slab                  int `json:"slab,omitempty"`
+	SlabReclaimable       int `json:"slab_reclaimable,omitempty"`
+	SlabUnreclaimable     int `json:"slab_unreclaimable,omitempty"`
+	Sock                  int `json:"sock,omitempty"`
+	ThpCollapseAlloc      int `json:"thp_collapse_alloc,omitempty"`
+	ThpFaultAlloc         int `json:"thp_fault_alloc,omitempty"`
+	WorkingsetActivate    int `json:"workingset_activate,omitempty"`
+	WorkingsetNodereclaim int `json:"workingset_nodereclaim,omitempty"`
+	WorkingsetRefault     int `json:"workingset_refault,omitempty"`
 }
 type MemoryStats struct {
 	Stats    Stats `json:"stats,omitempty"`
@@ -98,10 +132,30 @@ func Unmarshal(data []byte) (*DockerStats, error) {
 		return nil, err
 	}
 
+	// The cgroup version can only be told apart by which memory stats are
+	// present, so look at the keys rather than the zero valued fields
+	var raw struct {
+		MemoryStats struct {
+			Stats map[string]json.RawMessage `json:"stats"`
+		} `json:"memory_stats"`
+	}
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, err
+	}
+	_, stats.cgroupV1 = raw.MemoryStats.Stats["total_inactive_file"]
+
 	return &stats, nil
 }
 
-// used_memory = memory_stats.usage - memory_stats.stats.cache
+// IsCgroupV1 returns true if the stats come from a cgroup v1 host
+func (d *DockerStats) IsCgroupV1() bool {
+	return d.cgroupV1
+}
+
+// used_memory = memory_stats.usage - inactive_file
+// inactive_file = memory_stats.stats.total_inactive_file on cgroup v1
+// inactive_file = memory_stats.stats.inactive_file on cgroup v2
 // available_memory = memory_stats.limit
 // Memory usage % = (used_memory / available_memory) * 100.0
 // cpu_delta = cpu_stats.cpu_usage.total_usage - precpu_stats.cpu_usage.total_usage
@@ -109,8 +163,19 @@ func Unmarshal(data []byte) (*DockerStats, error) {
 // number_cpus = lenght(cpu_stats.cpu_usage.percpu_usage) or cpu_stats.online_cpus
 // CPU usage % = (cpu_delta / system_cpu_delta) * number_cpus * 100.0
 
+// From: https://github.com/docker/cli/blob/c1733165159c08101adb0e1f120c7181533550ef/cli/command/container/stats_helpers.go#L239-L254
 func (d *DockerStats) UsedMemory() int {
-	return d.MemoryStats.Usage - d.MemoryStats.Stats.Cache
+	usage := d.MemoryStats.Usage
+
+	// cgroup v1
+	if v := d.MemoryStats.Stats.TotalInactiveFile; d.cgroupV1 && v < usage {
+		return usage - v
+	}
+	// cgroup v2
+	if v := d.MemoryStats.Stats.InactiveFile; v < usage {
+		return usage - v
+	}
+	return usage
 }
 
 func (d *DockerStats) AvailableMemory() int {
@@ -118,6 +183,9 @@ func (d *DockerStats) AvailableMemory() int {
 }
 
 func (d *DockerStats) MemoryUsagePercentage() float64 {
+	if d.AvailableMemory() == 0 {
+		return 0
+	}
 	return float64(d.UsedMemory()) / float64(d.AvailableMemory()) * 100.0
 }
 
@@ -137,6 +205,66 @@ func (d *DockerStats) CpuUsagePercentage() float64 {
 	return (float64(d.CpuDelta()) / float64(d.SystemCpuDelta())) * float64(d.NumberCpus()) * 100.0
 }
 
+// CpuUserPercentage is the part of the CPU usage spent in user mode
+func (d *DockerStats) CpuUserPercentage() float64 {
+	delta := d.CPUStats.CPUUsage.UsageInUsermode - d.PrecpuStats.CPUUsage.UsageInUsermode
+	return d.cpuPercentage(delta)
+}
+
+// CpuSystemPercentage is the part of the CPU usage spent in kernel mode
+func (d *DockerStats) CpuSystemPercentage() float64 {
+	delta := d.CPUStats.CPUUsage.UsageInKernelmode - d.PrecpuStats.CPUUsage.UsageInKernelmode
+	return d.cpuPercentage(delta)
+}
+
+// PerCpuPercentages is the CPU usage on every CPU
+// Only reported on cgroup v1 hosts, nil otherwise
+func (d *DockerStats) PerCpuPercentages() []float64 {
+	usage := d.CPUStats.CPUUsage.PercpuUsage
+	if len(usage) == 0 {
+		return nil
+	}
+
+	ret := make([]float64, len(usage))
+	pre := d.PrecpuStats.CPUUsage.PercpuUsage
+	for i, u := range usage {
+		if i < len(pre) {
+			u -= pre[i]
+		}
+		// The system delta covers all CPUs, so scaling by their number makes
+		// this relative to a single CPU
+		ret[i] = d.cpuPercentage(u)
+	}
+	return ret
+}
+
+// cpuPercentage converts a CPU time delta into a percentage like docker stats
+func (d *DockerStats) cpuPercentage(delta int) float64 {
+	if d.SystemCpuDelta() <= 0 || delta < 0 {
+		return 0
+	}
+	return (float64(delta) / float64(d.SystemCpuDelta())) * float64(d.NumberCpus()) * 100.0
+}
+
+// ThrottledPercentage is the percentage of CPU periods the container was
+// throttled in because it hit its CPU limit
+func (d *DockerStats) ThrottledPercentage() float64 {
+	periods := d.CPUStats.ThrottlingData.Periods - d.PrecpuStats.ThrottlingData.Periods
+	throttled := d.CPUStats.ThrottlingData.ThrottledPeriods - d.PrecpuStats.ThrottlingData.ThrottledPeriods
+	if periods <= 0 || throttled < 0 {
+		return 0
+	}
+	return float64(throttled) / float64(periods) * 100.0
+}
+
+// PidsLimit returns the maximum number of processes, 0 if unlimited
+func (d *DockerStats) PidsLimit() int {
+	if d.PidsStats.Limit <= 0 || d.PidsStats.Limit >= math.MaxInt64 {
+		return 0
+	}
+	return int(d.PidsStats.Limit)
+}
+
 // From: https://github.com/docker/cli/blob/c1733165159c08101adb0e1f120c7181533550ef/cli/command/container/stats_helpers.go#LL217-L225C2
 func (d *DockerStats) NetworkStats() (float64, float64) {
 	var rx, tx float64
@@ -148,6 +276,17 @@ func (d *DockerStats) NetworkStats() (float64, float64) {
 	return rx, tx
 }
 
+// NetworkPackets returns the packets received and sent over all networks
+func (d *DockerStats) NetworkPackets() (int, int) {
+	var rx, tx int
+
+	for _, v := range d.Networks {
+		rx += v.RxPackets
+		tx += v.TxPackets
+	}
+	return rx, tx
+}
+
 // From: https://github.com/docker/cli/blob/c1733165159c08101adb0e1f120c7181533550ef/cli/command/container/stats_helpers.go#LL201-L215C2
 func (d *DockerStats) DiskStats() (uint64, uint64) {
 	var blkRead, blkWrite uint64
@@ -2,6 +2,7 @@ package dockerstats_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/dockwizard/dockwizard_agent/agent/pkg/dockerstats"
 	"github.com/stretchr/testify/require"
@@ -120,6 +121,70 @@ var testPayload = `
 	}
 `
 
+var testPayloadV1 = `
+	{
+		"read": "2023-02-20T10:03:01.998224131Z",
+		"preread": "2023-02-20T10:03:00.997215472Z",
+		"pids_stats": {
+			"current": 3,
+			"limit": 100
+		},
+		"cpu_stats": {
+			"cpu_usage": {
+				"total_usage": 100215355,
+				"percpu_usage": [8646879, 24472255, 36438778, 30657443],
+				"usage_in_kernelmode": 50000000,
+				"usage_in_usermode": 50000000
+			},
+			"system_cpu_usage": 739306590000000,
+			"online_cpus": 4,
+			"throttling_data": {
+				"periods": 200,
+				"throttled_periods": 50,
+				"throttled_time": 1500000000
+			}
+		},
+		"memory_stats": {
+			"usage": 9437184,
+			"max_usage": 10485760,
+			"stats": {
+				"active_anon": 4194304,
+				"active_file": 2097152,
+				"cache": 4194304,
+				"hierarchical_memory_limit": 9223372036854771712,
+				"inactive_anon": 0,
+				"inactive_file": 1048576,
+				"mapped_file": 1048576,
+				"pgfault": 964,
+				"pgmajfault": 0,
+				"pgpgin": 1150,
+				"pgpgout": 1003,
+				"rss": 4194304,
+				"rss_huge": 0,
+				"total_active_anon": 4194304,
+				"total_active_file": 2097152,
+				"total_cache": 4194304,
+				"total_inactive_anon": 0,
+				"total_inactive_file": 2097152,
+				"total_mapped_file": 1048576,
+				"total_pgfault": 964,
+				"total_pgmajfault": 0,
+				"total_pgpgin": 1150,
+				"total_pgpgout": 1003,
+				"total_rss": 4194304,
+				"total_rss_huge": 0,
+				"total_unevictable": 0,
+				"total_writeback": 0,
+				"unevictable": 0,
+				"writeback": 0
+			},
+			"limit": 1073741824
+		},
+		"name": "/test",
+		"id": "1"
+	}
+`
+
 func TestUnmarshal(t *testing.T) {
 	stats, err := dockerstats.Unmarshal([]byte(testPayload))
 	require.Nil(t, err)
@@ -128,11 +193,40 @@ func TestUnmarshal(t *testing.T) {
 	require.Equal(t, 4194304, stats.MemoryStats.Usage)
 }
 
+func TestUnmarshalReadTimes(t *testing.T) {
+	stats, err := dockerstats.Unmarshal([]byte(testPayloadV1))
+	require.Nil(t, err)
+
+	require.Equal(t, time.Date(2023, 2, 20, 10, 3, 1, 998224131, time.UTC), stats.Read)
+	require.Equal(t, time.Date(2023, 2, 20, 10, 3, 0, 997215472, time.UTC), stats.PreRead)
+}
+
 func TestUsedMemory(t *testing.T) {
 	stats, err := dockerstats.Unmarshal([]byte(testPayload))
 	require.Nil(t, err)
 
-	require.Equal(t, 4194304, stats.UsedMemory())
+	// usage - inactive_file
+	require.Equal(t, 2940928, stats.UsedMemory())
+	require.False(t, stats.IsCgroupV1())
+}
+
+func TestUsedMemoryCgroupV1(t *testing.T) {
+	stats, err := dockerstats.Unmarshal([]byte(testPayloadV1))
+	require.Nil(t, err)
+
+	// usage - total_inactive_file
+	require.Equal(t, 7340032, stats.UsedMemory())
+	require.True(t, stats.IsCgroupV1())
+}
+
+func TestUnmarshalCgroupV2(t *testing.T) {
+	stats, err := dockerstats.Unmarshal([]byte(testPayload))
+	require.Nil(t, err)
+
+	require.Equal(t, 811008, stats.MemoryStats.Stats.Anon)
+	require.Equal(t, 3108864, stats.MemoryStats.Stats.File)
+	require.Equal(t, 262440, stats.MemoryStats.Stats.Slab)
+	require.Equal(t, 262256, stats.MemoryStats.Stats.SlabUnreclaimable)
 }
 
 func TestAvailableMemory(t *testing.T) {
@@ -146,7 +240,21 @@ func TestMemoryUsagePercentage(t *testing.T) {
 	stats, err := dockerstats.Unmarshal([]byte(testPayload))
 	require.Nil(t, err)
 
-	require.Equal(t, 0.03343566475260547, stats.MemoryUsagePercentage())
+	require.Equal(t, 0.023444147746455788, stats.MemoryUsagePercentage())
+}
+
+func TestMemoryUsagePercentageCgroupV1(t *testing.T) {
+	stats, err := dockerstats.Unmarshal([]byte(testPayloadV1))
+	require.Nil(t, err)
+
+	require.Equal(t, 0.68359375, stats.MemoryUsagePercentage())
+}
+
+func TestMemoryUsagePercentageNoLimit(t *testing.T) {
+	stats, err := dockerstats.Unmarshal([]byte(`{"memory_stats": {"usage": 1}}`))
+	require.Nil(t, err)
+
+	require.Equal(t, 0.0, stats.MemoryUsagePercentage())
 }
 
 func TestCpuDelta(t *testing.T) {
@@ -186,6 +294,15 @@ func TestNetworkStats(t *testing.T) {
 	require.Equal(t, 10036.0, tx)
 }
 
+func TestNetworkPackets(t *testing.T) {
+	stats, err := dockerstats.Unmarshal([]byte(testPayload))
+	require.Nil(t, err)
+
+	rx, tx := stats.NetworkPackets()
+	require.Equal(t, 500, rx)
+	require.Equal(t, 142, tx)
+}
+
 func TestDiskStats(t *testing.T) {
 	stats, err := dockerstats.Unmarshal([]byte(testPayload))
 	require.Nil(t, err)
@@ -194,3 +311,46 @@ func TestDiskStats(t *testing.T) {
 	require.Equal(t, uint64(0x33a000), read)
 	require.Equal(t, uint64(0x0), write)
 }
+
+func TestCpuUserSystemPercentage(t *testing.T) {
+	stats, err := dockerstats.Unmarshal([]byte(testPayloadV1))
+	require.Nil(t, err)
+
+	// 50ms each of 739306.59s system time on 4 CPUs
+	require.InDelta(t, 2.7052e-05, stats.CpuUserPercentage(), 1e-9)
+	require.InDelta(t, 2.7052e-05, stats.CpuSystemPercentage(), 1e-9)
+}
+
+func TestPerCpuPercentages(t *testing.T) {
+	stats, err := dockerstats.Unmarshal([]byte(testPayloadV1))
+	require.Nil(t, err)
+
+	perCpu := stats.PerCpuPercentages()
+	require.Equal(t, 4, len(perCpu))
+	require.InDelta(t, 8646879/739306590000000.0*4*100, perCpu[0], 1e-12)
+
+	stats, err = dockerstats.Unmarshal([]byte(testPayload))
+	require.Nil(t, err)
+	require.Nil(t, stats.PerCpuPercentages())
+}
+
+func TestThrottledPercentage(t *testing.T) {
+	stats, err := dockerstats.Unmarshal([]byte(testPayloadV1))
+	require.Nil(t, err)
+	require.Equal(t, 25.0, stats.ThrottledPercentage())
+
+	stats, err = dockerstats.Unmarshal([]byte(testPayload))
+	require.Nil(t, err)
+	require.Equal(t, 0.0, stats.ThrottledPercentage())
+}
+
+func TestPidsLimit(t *testing.T) {
+	stats, err := dockerstats.Unmarshal([]byte(testPayloadV1))
+	require.Nil(t, err)
+	require.Equal(t, 100, stats.PidsLimit())
+
+	// No limit is reported as the largest uint64
+	stats, err = dockerstats.Unmarshal([]byte(testPayload))
+	require.Nil(t, err)
+	require.Equal(t, 0, stats.PidsLimit())
+}
@@ -0,0 +1,195 @@
+package doctor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/agent"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/backend/api"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/config"
+)
+
+const (
+	Pass = "pass"
+	Fail = "fail"
+	Skip = "skip"
+)
+
+// checkTimeout is the maximum time a single check may take
+var checkTimeout = 10 * time.Second
+
+// Result is the outcome of a single check
+type Result struct {
+	// Name is what was checked
+	Name string `json:"name"`
+
+	// Status is "pass", "fail" or "skip"
+	Status string `json:"status"`
+
+	// Message describes the outcome
+	Message string `json:"message"`
+}
+
+// Report is the outcome of all checks
+type Report struct {
+	// OK is true if no check failed
+	OK bool `json:"ok"`
+
+	Results []*Result `json:"results"`
+}
+
+// DockerFactory creates the docker client to check
+type DockerFactory func() (client.APIClient, error)
+
+// Run checks the config file at path, the docker daemon, the backends and
+// does one trial collection. Checks that depend on a failed one are skipped
+func Run(ctx context.Context, path string, newDocker DockerFactory) *Report {
+	r := &Report{OK: true}
+
+	cfg, err := config.Read(path)
+	if err != nil {
+		r.add("config", Fail, err.Error())
+	} else {
+		r.add("config", Pass, fmt.Sprintf("%s is valid", path))
+	}
+
+	cli, err := r.checkDocker(ctx, newDocker)
+	if cli != nil {
+		defer cli.Close()
+	}
+	dockerOK := err == nil
+
+	if cfg == nil {
+		r.add("backends", Skip, "the config is invalid")
+		r.add("collection", Skip, "the config is invalid")
+		return r
+	}
+
+	for _, b := range cfg.Backends {
+		r.checkBackend(ctx, b)
+	}
+
+	if !dockerOK {
+		r.add("collection", Skip, "docker is not reachable")
+		return r
+	}
+	r.checkCollection(ctx, cfg, cli)
+
+	return r
+}
+
+func (r *Report) add(name, status, message string) {
+	if status == Fail {
+		r.OK = false
+	}
+	r.Results = append(r.Results, &Result{
+		Name:    name,
+		Status:  status,
+		Message: message,
+	})
+}
+
+// checkDocker pings the docker daemon and negotiates the API version
+// The client is returned even if the check failed so it can be closed
+func (r *Report) checkDocker(ctx context.Context, newDocker DockerFactory) (client.APIClient, error) {
+	cli, err := newDocker()
+	if err != nil {
+		r.add("docker", Fail, fmt.Sprintf("could not create client: %v", err))
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	ping, err := cli.Ping(ctx)
+	if err != nil {
+		r.add("docker", Fail, fmt.Sprintf("%s is not reachable: %v", cli.DaemonHost(), err))
+		return cli, err
+	}
+	cli.NegotiateAPIVersionPing(ping)
+
+	message := fmt.Sprintf("%s is reachable, API version %s", cli.DaemonHost(), cli.ClientVersion())
+	version, err := cli.ServerVersion(ctx)
+	if err == nil {
+		message += fmt.Sprintf(", engine %s", version.Version)
+	}
+	r.add("docker", Pass, message)
+	return cli, nil
+}
+
+// checkBackend checks that the backend can be reached
+// Only api backends have something to reach
+func (r *Report) checkBackend(ctx context.Context, b config.Backend) {
+	name := fmt.Sprintf("backend %s", b.Name)
+	if b.Type != "api" {
+		r.add(name, Skip, fmt.Sprintf("nothing to check for %s backends", b.Type))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	err := api.New(&b, nil).Check(ctx)
+	if err != nil {
+		r.add(name, Fail, fmt.Sprintf("%s: %v", b.APIEndpoint, err))
+		return
+	}
+	r.add(name, Pass, fmt.Sprintf("%s accepted the api key", b.APIEndpoint))
+}
+
+// checkCollection collects the metrics once, without changing anything on the host
+func (r *Report) checkCollection(ctx context.Context, cfg *config.Config, cli client.APIClient) {
+	a, err := agent.New(cfg, nil, cli, agent.WithoutPersistentID())
+	if err != nil {
+		r.add("collection", Fail, err.Error())
+		return
+	}
+
+	metrics, err := a.Collect(ctx)
+	if err != nil {
+		r.add("collection", Fail, err.Error())
+		return
+	}
+
+	var failed []string
+	for _, c := range metrics.Container {
+		if c.Error != "" {
+			failed = append(failed, fmt.Sprintf("%s: %s", c.Name, c.Error))
+		}
+	}
+	if metrics.Host != nil && metrics.Host.Error != "" {
+		failed = append(failed, fmt.Sprintf("host: %s", metrics.Host.Error))
+	}
+	if len(failed) > 0 {
+		r.add("collection", Fail, fmt.Sprintf("collected %d containers with errors: %s",
+			len(metrics.Container), strings.Join(failed, "; ")))
+		return
+	}
+	r.add("collection", Pass, fmt.Sprintf("collected %d containers", len(metrics.Container)))
+}
+
+// WriteText writes the report in a human readable form
+func (r *Report) WriteText(w io.Writer) error {
+	failed := 0
+	for _, result := range r.Results {
+		if result.Status == Fail {
+			failed++
+		}
+		_, err := fmt.Fprintf(w, "[%s] %s: %s\n", result.Status, result.Name, result.Message)
+		if err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if failed == 0 {
+		_, err = fmt.Fprintln(w, "all checks passed")
+	} else {
+		_, err = fmt.Fprintf(w, "%d of %d checks failed\n", failed, len(r.Results))
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package doctor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/dockwizard/dockwizard_agent/agent/internal/testutils"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "dockwizard.yaml")
+	require.Nil(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestRun(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer 123" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("invalid api key"))
+		}
+	}))
+	defer srv.Close()
+
+	path := writeConfig(t, fmt.Sprintf(`---
+update_frequency: 2
+backends:
+  - type: api
+    name: good
+    api_endpoint: %s
+    api_key: "123"
+  - type: api
+    name: bad
+    api_endpoint: %s
+    api_key: "456"
+  - type: stdout
+`, srv.URL, srv.URL))
+
+	ctrl := gomock.NewController(t)
+	m := testutils.NewMockAPIClient(ctrl)
+	m.EXPECT().Ping(gomock.Any()).Return(types.Ping{APIVersion: "1.41"}, nil)
+	m.EXPECT().NegotiateAPIVersionPing(types.Ping{APIVersion: "1.41"})
+	m.EXPECT().DaemonHost().Return("unix:///var/run/docker.sock").AnyTimes()
+	m.EXPECT().ClientVersion().Return("1.41")
+	m.EXPECT().ServerVersion(gomock.Any()).Return(types.Version{Version: "24.0.5"}, nil).Times(2)
+	m.EXPECT().ContainerList(gomock.Any(), types.ContainerListOptions{}).
+		Return([]types.Container{{ID: "1", Names: []string{"/web"}, State: "running"}}, nil)
+	m.EXPECT().ContainerStatsOneShot(gomock.Any(), "1").
+		Return(types.ContainerStats{Body: io.NopCloser(bytes.NewBufferString("{}"))}, nil)
+	m.EXPECT().ContainerInspect(gomock.Any(), "1").Return(types.ContainerJSON{}, nil)
+	m.EXPECT().Close().Return(nil)
+
+	r := Run(context.Background(), path, func() (client.APIClient, error) { return m, nil })
+	require.False(t, r.OK)
+	require.Equal(t, 6, len(r.Results))
+
+	require.Equal(t, &Result{Name: "config", Status: Pass, Message: path + " is valid"}, r.Results[0])
+	require.Equal(t, &Result{
+		Name:    "docker",
+		Status:  Pass,
+		Message: "unix:///var/run/docker.sock is reachable, API version 1.41, engine 24.0.5",
+	}, r.Results[1])
+	require.Equal(t, Pass, r.Results[2].Status)
+	require.Equal(t, "backend bad", r.Results[3].Name)
+	require.Equal(t, Fail, r.Results[3].Status)
+	require.Equal(t, srv.URL+": api key was rejected: response: invalid api key", r.Results[3].Message)
+	require.Equal(t, &Result{Name: "backend stdout", Status: Skip, Message: "nothing to check for stdout backends"}, r.Results[4])
+	require.Equal(t, "collection", r.Results[5].Name)
+	require.Contains(t, r.Results[5].Message, "collected 1 containers")
+
+	// Checking must not leave an agent ID behind
+	_, err := os.Stat(filepath.Join(filepath.Dir(path), "agent-id"))
+	require.True(t, os.IsNotExist(err))
+
+	var buf bytes.Buffer
+	require.Nil(t, r.WriteText(&buf))
+	require.Contains(t, buf.String(), "[fail] backend bad: ")
+	require.Contains(t, buf.String(), "checks failed\n")
+}
+
+func TestRunInvalidConfig(t *testing.T) {
+	path := writeConfig(t, "update_frequency: 1\n")
+
+	r := Run(context.Background(), path, func() (client.APIClient, error) {
+		return nil, fmt.Errorf("unable to parse docker host `tcp:/`")
+	})
+	require.False(t, r.OK)
+	require.Equal(t, []*Result{
+		{Name: "config", Status: Fail, Message: "update frequency must be at least 2 seconds"},
+		{Name: "docker", Status: Fail, Message: "could not create client: unable to parse docker host `tcp:/`"},
+		{Name: "backends", Status: Skip, Message: "the config is invalid"},
+		{Name: "collection", Status: Skip, Message: "the config is invalid"},
+	}, r.Results)
+}
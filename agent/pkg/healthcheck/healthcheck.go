@@ -0,0 +1,288 @@
+package healthcheck
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/config"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+)
+
+const defaultTimeout = 5 * time.Second
+
+// execPollInterval is how often a running exec check is inspected
+var execPollInterval = 100 * time.Millisecond
+
+type rule struct {
+	container config.Container
+	regex     *regexp.Regexp
+}
+
+// Runner runs the configured health checks against containers
+type Runner struct {
+	docker client.APIClient
+	client *http.Client
+	dialer *net.Dialer
+	rules  []rule
+
+	mu sync.Mutex
+	// exceeded counts the consecutive polls a metric check has been over its threshold
+	exceeded map[string]int
+}
+
+func New(containers []config.Container, cli client.APIClient) (*Runner, error) {
+	var rules []rule
+	for _, c := range containers {
+		r := rule{container: c}
+		if c.Regex != "" {
+			re, err := regexp.Compile(c.Regex)
+			if err != nil {
+				return nil, err
+			}
+			r.regex = re
+		}
+		rules = append(rules, r)
+	}
+
+	return &Runner{
+		docker:   cli,
+		client:   &http.Client{},
+		dialer:   &net.Dialer{},
+		rules:    rules,
+		exceeded: map[string]int{},
+	}, nil
+}
+
+func (r *rule) matches(name string, labels map[string]string) bool {
+	if r.container.Name != "" {
+		ok, err := path.Match(r.container.Name, name)
+		if err != nil || !ok {
+			return false
+		}
+	}
+	if r.regex != nil && !r.regex.MatchString(name) {
+		return false
+	}
+	for k, v := range r.container.Labels {
+		if l, ok := labels[k]; !ok || l != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Run runs every check of every rule matching the container and returns the results
+// metrics must already hold the container's current usage for metric checks
+func (r *Runner) Run(ctx context.Context, container types.Container, metrics *data.ContainerMetrics) []*data.HealthCheckResult {
+	var ret []*data.HealthCheckResult
+	for i := range r.rules {
+		rule := &r.rules[i]
+		if !rule.matches(metrics.Name, container.Labels) {
+			continue
+		}
+
+		for j, check := range rule.container.Checks {
+			key := fmt.Sprintf("%s/%d/%d", container.ID, i, j)
+			ret = append(ret, r.runCheck(ctx, key, container, metrics, check))
+		}
+	}
+	return ret
+}
+
+// Prune forgets the metric check counts of containers that are no longer listed
+func (r *Runner) Prune(ids map[string]bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key := range r.exceeded {
+		id, _, _ := strings.Cut(key, "/")
+		if !ids[id] {
+			delete(r.exceeded, key)
+		}
+	}
+}
+
+func (r *Runner) runCheck(ctx context.Context, key string, container types.Container, metrics *data.ContainerMetrics, check config.Check) *data.HealthCheckResult {
+	timeout := defaultTimeout
+	if check.Timeout > 0 {
+		timeout = time.Duration(check.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	res := &data.HealthCheckResult{
+		Type: check.Type,
+	}
+
+	var err error
+	switch check.Type {
+	case "http":
+		err = r.checkHTTP(ctx, res, container, check)
+	case "tcp":
+		err = r.checkTCP(ctx, res, container, check)
+	case "exec":
+		err = r.checkExec(ctx, res, container, check)
+	case "metric":
+		err = r.checkMetric(key, res, metrics, check)
+	default:
+		err = fmt.Errorf("unknown check type %q", check.Type)
+	}
+
+	if err != nil {
+		res.Message = err.Error()
+		return res
+	}
+	res.Healthy = true
+	return res
+}
+
+func (r *Runner) checkHTTP(ctx context.Context, res *data.HealthCheckResult, container types.Container, check config.Check) error {
+	addr, err := address(container, check.Port)
+	if err != nil {
+		return err
+	}
+
+	p := check.Path
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	url := fmt.Sprintf("http://%s%s", addr, p)
+	res.Target = url
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (r *Runner) checkTCP(ctx context.Context, res *data.HealthCheckResult, container types.Container, check config.Check) error {
+	addr, err := address(container, check.Port)
+	if err != nil {
+		return err
+	}
+	res.Target = addr
+
+	conn, err := r.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (r *Runner) checkExec(ctx context.Context, res *data.HealthCheckResult, container types.Container, check config.Check) error {
+	res.Target = strings.Join(check.Command, " ")
+
+	exec, err := r.docker.ContainerExecCreate(ctx, container.ID, types.ExecConfig{
+		Cmd: check.Command,
+	})
+	if err != nil {
+		return err
+	}
+	err = r.docker.ContainerExecStart(ctx, exec.ID, types.ExecStartCheck{Detach: true})
+	if err != nil {
+		return err
+	}
+
+	for {
+		inspect, err := r.docker.ContainerExecInspect(ctx, exec.ID)
+		if err != nil {
+			return err
+		}
+		if !inspect.Running {
+			if inspect.ExitCode != 0 {
+				return fmt.Errorf("command exited with code %d", inspect.ExitCode)
+			}
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(execPollInterval):
+		}
+	}
+}
+
+func (r *Runner) checkMetric(key string, res *data.HealthCheckResult, metrics *data.ContainerMetrics, check config.Check) error {
+	res.Target = check.Metric
+
+	// Without stats there is nothing to compare, keep the current count
+	if metrics.Error != "" {
+		return fmt.Errorf("metrics unavailable: %s", metrics.Error)
+	}
+
+	var value float64
+	switch check.Metric {
+	case "cpu":
+		value = metrics.CPUUsage
+	case "memory":
+		value = metrics.MemoryUsagePercentage
+	default:
+		return fmt.Errorf("unknown metric %q", check.Metric)
+	}
+
+	polls := check.Polls
+	if polls < 1 {
+		polls = 1
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if value <= check.Threshold {
+		delete(r.exceeded, key)
+		return nil
+	}
+
+	r.exceeded[key]++
+	if r.exceeded[key] < polls {
+		return nil
+	}
+	return fmt.Errorf("%s usage %.3f above %.3f for %d polls", check.Metric, value, check.Threshold, r.exceeded[key])
+}
+
+// address returns the host:port a check can reach the container port on
+func address(container types.Container, port int) (string, error) {
+	if container.HostConfig.NetworkMode == "host" {
+		return net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), nil
+	}
+	if container.NetworkSettings == nil {
+		return "", fmt.Errorf("container has no network settings")
+	}
+
+	// Sort the networks so the same address is picked every poll
+	var names []string
+	for name := range container.NetworkSettings.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		n := container.NetworkSettings.Networks[name]
+		if n != nil && n.IPAddress != "" {
+			return net.JoinHostPort(n.IPAddress, strconv.Itoa(port)), nil
+		}
+	}
+	return "", fmt.Errorf("container has no IP address")
+}
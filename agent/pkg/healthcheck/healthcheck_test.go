@@ -0,0 +1,204 @@
+package healthcheck
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/dockwizard/dockwizard_agent/agent/internal/testutils"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/config"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+)
+
+func newContainer(ip string) types.Container {
+	return types.Container{
+		ID:     "1",
+		Names:  []string{"/web"},
+		Labels: map[string]string{"team": "a"},
+		NetworkSettings: &types.SummaryNetworkSettings{
+			Networks: map[string]*network.EndpointSettings{
+				"bridge": {IPAddress: ip},
+			},
+		},
+	}
+}
+
+func splitPort(t *testing.T, addr string) int {
+	_, p, err := net.SplitHostPort(addr)
+	require.Nil(t, err)
+	port, err := strconv.Atoi(p)
+	require.Nil(t, err)
+	return port
+}
+
+func TestMatches(t *testing.T) {
+	r, err := New([]config.Container{
+		{Name: "web*"},
+		{Regex: "^db-[0-9]+$"},
+		{Labels: map[string]string{"team": "a"}},
+		{Name: "web", Labels: map[string]string{"team": "b"}},
+	}, nil)
+	require.Nil(t, err)
+
+	require.True(t, r.rules[0].matches("web-1", nil))
+	require.False(t, r.rules[0].matches("api", nil))
+	require.True(t, r.rules[1].matches("db-1", nil))
+	require.False(t, r.rules[1].matches("db-x", nil))
+	require.True(t, r.rules[2].matches("any", map[string]string{"team": "a"}))
+	require.False(t, r.rules[2].matches("any", map[string]string{"team": "b"}))
+	require.False(t, r.rules[3].matches("web", map[string]string{"team": "a"}))
+}
+
+func TestNewInvalidRegex(t *testing.T) {
+	_, err := New([]config.Container{{Regex: "("}}, nil)
+	require.NotNil(t, err)
+}
+
+func TestRunNoMatch(t *testing.T) {
+	r, err := New([]config.Container{
+		{Name: "db", Checks: []config.Check{{Type: "tcp", Port: 1}}},
+	}, nil)
+	require.Nil(t, err)
+
+	res := r.Run(context.Background(), newContainer("127.0.0.1"), &data.ContainerMetrics{Name: "web"})
+	require.Equal(t, 0, len(res))
+}
+
+func TestRunHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	port := splitPort(t, srv.Listener.Addr().String())
+
+	r, err := New([]config.Container{
+		{
+			Name: "web",
+			Checks: []config.Check{
+				{Type: "http", Port: port, Path: "health"},
+				{Type: "http", Port: port, Path: "/down"},
+			},
+		},
+	}, nil)
+	require.Nil(t, err)
+
+	res := r.Run(context.Background(), newContainer("127.0.0.1"), &data.ContainerMetrics{Name: "web"})
+	require.Equal(t, 2, len(res))
+	require.True(t, res[0].Healthy)
+	require.Equal(t, "http://127.0.0.1:"+strconv.Itoa(port)+"/health", res[0].Target)
+	require.False(t, res[1].Healthy)
+	require.Equal(t, "unexpected status code 503", res[1].Message)
+}
+
+func TestRunTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	port := splitPort(t, l.Addr().String())
+
+	r, err := New([]config.Container{
+		{Name: "web", Checks: []config.Check{{Type: "tcp", Port: port}}},
+	}, nil)
+	require.Nil(t, err)
+
+	res := r.Run(context.Background(), newContainer("127.0.0.1"), &data.ContainerMetrics{Name: "web"})
+	require.True(t, res[0].Healthy)
+
+	l.Close()
+	res = r.Run(context.Background(), newContainer("127.0.0.1"), &data.ContainerMetrics{Name: "web"})
+	require.False(t, res[0].Healthy)
+}
+
+func TestRunNoAddress(t *testing.T) {
+	r, err := New([]config.Container{
+		{Name: "web", Checks: []config.Check{{Type: "tcp", Port: 80}}},
+	}, nil)
+	require.Nil(t, err)
+
+	res := r.Run(context.Background(), newContainer(""), &data.ContainerMetrics{Name: "web"})
+	require.False(t, res[0].Healthy)
+	require.Equal(t, "container has no IP address", res[0].Message)
+}
+
+func TestRunExec(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	m := testutils.NewMockAPIClient(ctrl)
+
+	r, err := New([]config.Container{
+		{Name: "web", Checks: []config.Check{{Type: "exec", Command: []string{"true"}}}},
+	}, m)
+	require.Nil(t, err)
+
+	m.EXPECT().
+		ContainerExecCreate(gomock.Any(), "1", types.ExecConfig{Cmd: []string{"true"}}).
+		Return(types.IDResponse{ID: "exec"}, nil)
+	m.EXPECT().
+		ContainerExecStart(gomock.Any(), "exec", types.ExecStartCheck{Detach: true}).
+		Return(nil)
+	gomock.InOrder(
+		m.EXPECT().
+			ContainerExecInspect(gomock.Any(), "exec").
+			Return(types.ContainerExecInspect{Running: true}, nil),
+		m.EXPECT().
+			ContainerExecInspect(gomock.Any(), "exec").
+			Return(types.ContainerExecInspect{ExitCode: 1}, nil),
+	)
+
+	res := r.Run(context.Background(), newContainer(""), &data.ContainerMetrics{Name: "web"})
+	require.False(t, res[0].Healthy)
+	require.Equal(t, "command exited with code 1", res[0].Message)
+	require.Equal(t, "true", res[0].Target)
+}
+
+func TestRunMetric(t *testing.T) {
+	r, err := New([]config.Container{
+		{Name: "web", Checks: []config.Check{{Type: "metric", Metric: "cpu", Threshold: 50, Polls: 2}}},
+	}, nil)
+	require.Nil(t, err)
+
+	high := &data.ContainerMetrics{Name: "web", CPUUsage: 80}
+	low := &data.ContainerMetrics{Name: "web", CPUUsage: 10}
+
+	require.True(t, r.Run(context.Background(), newContainer(""), high)[0].Healthy)
+	require.False(t, r.Run(context.Background(), newContainer(""), high)[0].Healthy)
+	require.True(t, r.Run(context.Background(), newContainer(""), low)[0].Healthy)
+	require.True(t, r.Run(context.Background(), newContainer(""), high)[0].Healthy)
+	require.Equal(t, 1, len(r.exceeded))
+}
+
+func TestPrune(t *testing.T) {
+	r, err := New([]config.Container{
+		{Name: "web", Checks: []config.Check{{Type: "metric", Metric: "cpu", Threshold: 50, Polls: 2}}},
+	}, nil)
+	require.Nil(t, err)
+
+	container := newContainer("")
+	r.Run(context.Background(), container, &data.ContainerMetrics{Name: "web", CPUUsage: 80})
+	require.Equal(t, 1, len(r.exceeded))
+
+	r.Prune(map[string]bool{container.ID: true})
+	require.Equal(t, 1, len(r.exceeded))
+
+	r.Prune(map[string]bool{"other": true})
+	require.Equal(t, 0, len(r.exceeded))
+}
+
+func TestRunMetricUnavailable(t *testing.T) {
+	r, err := New([]config.Container{
+		{Name: "web", Checks: []config.Check{{Type: "metric", Metric: "memory", Threshold: 50}}},
+	}, nil)
+	require.Nil(t, err)
+
+	res := r.Run(context.Background(), newContainer(""), &data.ContainerMetrics{Name: "web", Error: "gone"})
+	require.False(t, res[0].Healthy)
+	require.Equal(t, "metrics unavailable: gone", res[0].Message)
+	require.Equal(t, 0, len(r.exceeded))
+}
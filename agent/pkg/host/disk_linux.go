@@ -0,0 +1,15 @@
+package host
+
+import "syscall"
+
+// statfs returns the size of the filesystem at path, its free space and the
+// free space available to unprivileged users in bytes
+func statfs(path string) (total, free, avail uint64, err error) {
+	var st syscall.Statfs_t
+	err = syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	bsize := uint64(st.Bsize)
+	return st.Blocks * bsize, st.Bfree * bsize, st.Bavail * bsize, nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package host
+
+import "fmt"
+
+func statfs(path string) (total, free, avail uint64, err error) {
+	return 0, 0, 0, fmt.Errorf("disk usage is only supported on linux")
+}
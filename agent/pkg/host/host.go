@@ -0,0 +1,268 @@
+package host
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+)
+
+// cpuTimes are the cumulative CPU times of all CPUs from /proc/stat
+type cpuTimes struct {
+	busy  uint64
+	total uint64
+}
+
+// Collector reads the identity and usage of the host
+// All paths are read below root so the agent can run in a container with the
+// host's filesystem mounted
+type Collector struct {
+	root    string
+	agentID string
+
+	mu sync.Mutex
+	// prev is the previous CPU sample, nil before the first one
+	prev *cpuTimes
+}
+
+func New(root, agentID string) *Collector {
+	if root == "" {
+		root = "/"
+	}
+	return &Collector{
+		root:    root,
+		agentID: agentID,
+	}
+}
+
+// Collect reads the host metrics
+// Metrics that can not be read are left zero and the errors are recorded on
+// the result, so a missing file does not hide the rest
+func (c *Collector) Collect() *data.Host {
+	host := &data.Host{
+		AgentID:   c.agentID,
+		Timestamp: time.Now().UTC(),
+	}
+
+	var errs []string
+	record := func(err error) {
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	host.Hostname, _ = c.hostname()
+	host.OS = c.osName()
+	kernel, err := c.readFile("proc/sys/kernel/osrelease")
+	record(err)
+	host.Kernel = kernel
+
+	record(c.cpu(host))
+	record(c.memory(host))
+	record(c.load(host))
+	record(c.disk(host))
+
+	host.Error = strings.Join(errs, "; ")
+	return host
+}
+
+func (c *Collector) path(name string) string {
+	return filepath.Join(c.root, name)
+}
+
+func (c *Collector) readFile(name string) (string, error) {
+	bts, err := os.ReadFile(c.path(name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(bts)), nil
+}
+
+// hostname returns the host name of the host
+// Inside a container os.Hostname returns the container's name, so the
+// mounted /etc/hostname is preferred if a host root is set
+func (c *Collector) hostname() (string, error) {
+	if c.root != "/" {
+		name, err := c.readFile("etc/hostname")
+		if err == nil && name != "" {
+			return name, nil
+		}
+	}
+	return os.Hostname()
+}
+
+// osName returns the PRETTY_NAME from os-release, or GOOS if there is none
+func (c *Collector) osName() string {
+	for _, name := range []string{"etc/os-release", "usr/lib/os-release"} {
+		f, err := os.Open(c.path(name))
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			key, value, ok := strings.Cut(scanner.Text(), "=")
+			if ok && key == "PRETTY_NAME" {
+				return strings.Trim(value, `"'`)
+			}
+		}
+	}
+	return runtime.GOOS
+}
+
+// cpu reads the CPU count and usage since the previous sample from /proc/stat
+func (c *Collector) cpu(host *data.Host) error {
+	f, err := os.Open(c.path("proc/stat"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var times *cpuTimes
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+		if fields[0] != "cpu" {
+			host.CPUs++
+			continue
+		}
+
+		// user nice system idle iowait irq softirq steal, guest time is
+		// already included in user and nice
+		times = &cpuTimes{}
+		for i, field := range fields[1:] {
+			if i >= 8 {
+				break
+			}
+			v, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid cpu line in /proc/stat: %w", err)
+			}
+			times.total += v
+			if i != 3 && i != 4 {
+				times.busy += v
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if times == nil {
+		return fmt.Errorf("no cpu line in /proc/stat")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.prev != nil && times.total > c.prev.total && times.busy >= c.prev.busy {
+		usage := float64(times.busy-c.prev.busy) / float64(times.total-c.prev.total) * 100
+		host.CPUUsage = math.Round(usage*1000) / 1000
+	}
+	c.prev = times
+	return nil
+}
+
+// memory reads the memory usage from /proc/meminfo
+// MemAvailable is what the kernel could hand out without swapping, so
+// caches it can drop do not count as used
+func (c *Collector) memory(host *data.Host) error {
+	f, err := os.Open(c.path("proc/meminfo"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	values := map[string]int{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		// The values are in kB
+		values[strings.TrimSuffix(fields[0], ":")] = v * 1024
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	total, ok := values["MemTotal"]
+	if !ok || total == 0 {
+		return fmt.Errorf("no MemTotal in /proc/meminfo")
+	}
+	available, ok := values["MemAvailable"]
+	if !ok {
+		// Kernels before 3.14 do not report MemAvailable
+		available = values["MemFree"] + values["Buffers"] + values["Cached"]
+	}
+
+	host.MemoryTotal = total
+	host.MemoryUsage = total - available
+	host.MemoryUsagePercentage = math.Round(float64(host.MemoryUsage)/float64(total)*100*1000) / 1000
+	return nil
+}
+
+// load reads the load averages from /proc/loadavg
+func (c *Collector) load(host *data.Host) error {
+	line, err := c.readFile("proc/loadavg")
+	if err != nil {
+		return err
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return fmt.Errorf("invalid /proc/loadavg: %q", line)
+	}
+	loads := make([]float64, 3)
+	for i := range loads {
+		loads[i], err = strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return fmt.Errorf("invalid /proc/loadavg: %w", err)
+		}
+	}
+	host.Load1, host.Load5, host.Load15 = loads[0], loads[1], loads[2]
+	return nil
+}
+
+// disk reads the usage of the root filesystem
+func (c *Collector) disk(host *data.Host) error {
+	total, free, avail, err := statfs(c.root)
+	if err != nil {
+		return err
+	}
+	if total == 0 {
+		return nil
+	}
+
+	used, percentage := diskUsage(total, free, avail)
+	host.DiskTotal = int(total)
+	host.DiskUsage = int(used)
+	host.DiskUsagePercentage = percentage
+	return nil
+}
+
+// diskUsage returns the used space and its percentage the way df does
+// Blocks reserved for root are neither used nor available, so the percentage
+// is of the space unprivileged users can use
+func diskUsage(total, free, avail uint64) (uint64, float64) {
+	used := total - free
+	if used+avail == 0 {
+		return used, 0
+	}
+	return used, math.Round(float64(used)/float64(used+avail)*100*1000) / 1000
+}
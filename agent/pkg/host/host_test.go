@@ -0,0 +1,134 @@
+package host
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testStat = `cpu  %d 0 %d %d 0 0 0 0 0 0
+cpu0 100 0 100 800 0 0 0 0 0 0
+cpu1 100 0 100 800 0 0 0 0 0 0
+intr 1000
+`
+
+var testMeminfo = `MemTotal:        8000000 kB
+MemFree:         1000000 kB
+MemAvailable:    6000000 kB
+Buffers:          100000 kB
+Cached:          4000000 kB
+`
+
+func writeFile(t *testing.T, root, name, content string) {
+	path := filepath.Join(root, name)
+	require.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.Nil(t, os.WriteFile(path, []byte(content), 0644))
+}
+
+func writeStat(t *testing.T, root string, user, system, idle int) {
+	writeFile(t, root, "proc/stat", fmt.Sprintf(testStat, user, system, idle))
+}
+
+func newRoot(t *testing.T) string {
+	root := t.TempDir()
+	writeStat(t, root, 200, 200, 1600)
+	writeFile(t, root, "proc/meminfo", testMeminfo)
+	writeFile(t, root, "proc/loadavg", "0.50 0.25 0.10 1/123 4567\n")
+	writeFile(t, root, "proc/sys/kernel/osrelease", "6.1.0-13-amd64\n")
+	writeFile(t, root, "etc/hostname", "node-1\n")
+	writeFile(t, root, "etc/os-release", "NAME=\"Debian GNU/Linux\"\nPRETTY_NAME=\"Debian GNU/Linux 12 (bookworm)\"\n")
+	return root
+}
+
+func TestCollect(t *testing.T) {
+	root := newRoot(t)
+	c := New(root, "abc")
+
+	host := c.Collect()
+	require.Equal(t, "abc", host.AgentID)
+	require.Equal(t, "node-1", host.Hostname)
+	require.Equal(t, "Debian GNU/Linux 12 (bookworm)", host.OS)
+	require.Equal(t, "6.1.0-13-amd64", host.Kernel)
+	require.Equal(t, 2, host.CPUs)
+	require.Equal(t, 0.0, host.CPUUsage)
+	require.Equal(t, 8000000*1024, host.MemoryTotal)
+	require.Equal(t, 2000000*1024, host.MemoryUsage)
+	require.Equal(t, 25.0, host.MemoryUsagePercentage)
+	require.Equal(t, 0.5, host.Load1)
+	require.Equal(t, 0.25, host.Load5)
+	require.Equal(t, 0.1, host.Load15)
+	if runtime.GOOS == "linux" {
+		require.Equal(t, "", host.Error)
+		require.True(t, host.DiskTotal > 0)
+	}
+
+	// 300 of the 1000 jiffies since the first sample were busy
+	writeStat(t, root, 400, 300, 2300)
+	host = c.Collect()
+	require.Equal(t, 30.0, host.CPUUsage)
+}
+
+func TestDiskUsage(t *testing.T) {
+	// 5% of the blocks are reserved for root
+	used, percentage := diskUsage(1000, 550, 500)
+	require.Equal(t, uint64(450), used)
+	require.Equal(t, 47.368, percentage)
+
+	used, percentage = diskUsage(1000, 0, 0)
+	require.Equal(t, uint64(1000), used)
+	require.Equal(t, 100.0, percentage)
+
+	_, percentage = diskUsage(0, 0, 0)
+	require.Equal(t, 0.0, percentage)
+}
+
+func TestCollectMissing(t *testing.T) {
+	root := newRoot(t)
+	require.Nil(t, os.Remove(filepath.Join(root, "proc/loadavg")))
+
+	host := New(root, "abc").Collect()
+	require.Contains(t, host.Error, "loadavg: no such file or directory")
+	require.Equal(t, 0.0, host.Load1)
+	require.Equal(t, 8000000*1024, host.MemoryTotal)
+}
+
+func TestLoadID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dockwizard", "agent-id")
+
+	id, err := LoadID(path, true)
+	require.Nil(t, err)
+	require.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, id)
+
+	again, err := LoadID(path, true)
+	require.Nil(t, err)
+	require.Equal(t, id, again)
+
+	// A stored ID is used even if it must not be written
+	again, err = LoadID(path, false)
+	require.Nil(t, err)
+	require.Equal(t, id, again)
+}
+
+func TestLoadIDNotPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent-id")
+
+	id, err := LoadID(path, false)
+	require.Nil(t, err)
+	require.NotEmpty(t, id)
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestLoadIDReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	// A file where the directory should be makes the ID impossible to store
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "config"), nil, 0644))
+
+	id, err := LoadID(filepath.Join(dir, "config", "agent-id"), true)
+	require.NotNil(t, err)
+	require.NotEmpty(t, id)
+}
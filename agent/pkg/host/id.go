@@ -0,0 +1,57 @@
+package host
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LoadID returns the agent ID stored in path
+// If there is none yet a new random ID is generated and, if persist is true,
+// written to path so the ID stays the same across restarts. If the file can
+// not be read or written the new ID is returned along with the error, so the
+// agent can keep running with an ID that only lasts until it restarts
+func LoadID(path string, persist bool) (string, error) {
+	bts, readErr := os.ReadFile(path)
+	if readErr == nil {
+		id := strings.TrimSpace(string(bts))
+		if id != "" {
+			return id, nil
+		}
+	}
+
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+	if readErr != nil && !os.IsNotExist(readErr) {
+		return id, readErr
+	}
+	if !persist {
+		return id, nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return id, err
+	}
+	err = os.WriteFile(path, []byte(id+"\n"), 0644)
+	if err != nil {
+		return id, err
+	}
+	return id, nil
+}
+
+// newID returns a random version 4 UUID
+func newID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
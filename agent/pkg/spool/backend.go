@@ -0,0 +1,69 @@
+package spool
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/backend"
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+)
+
+// replayBatches is how many spooled batches are sent along with every new
+// one, so draining a long backlog does not hold up collection
+const replayBatches = 5
+
+type spooled struct {
+	backend backend.Backend
+	spool   *Spool
+}
+
+// Wrap returns a backend that spools the metrics b fails to send and replays
+// everything spooled before newer metrics are sent. While a backlog is
+// replayed newer metrics are spooled behind it to keep them in order
+func (s *Spool) Wrap(b backend.Backend) *spooled {
+	return &spooled{
+		backend: b,
+		spool:   s,
+	}
+}
+
+func (s *spooled) SendData(ctx context.Context, metrics *data.Metrics) error {
+	left, err := s.replay(ctx, replayBatches)
+	if err == nil && left > 0 {
+		return s.spool.Push(metrics)
+	}
+	if err == nil {
+		err = s.backend.SendData(ctx, metrics)
+	}
+	if err == nil {
+		return nil
+	}
+
+	spoolErr := s.spool.Push(metrics)
+	if spoolErr != nil {
+		return fmt.Errorf("%v, failed to spool metrics: %v", err, spoolErr)
+	}
+	return fmt.Errorf("%w, metrics spooled", err)
+}
+
+// Spool stores the metrics to be sent with a later call to SendData
+func (s *spooled) Spool(metrics *data.Metrics) error {
+	return s.spool.Push(metrics)
+}
+
+// Close makes a last attempt to send the spooled metrics until ctx is done
+// and closes the wrapped backend. Whatever could not be sent stays on disk
+func (s *spooled) Close(ctx context.Context) error {
+	_, err := s.replay(ctx, 0)
+	closeErr := backend.Close(ctx, s.backend)
+	if err != nil {
+		return fmt.Errorf("could not send spooled metrics: %w", err)
+	}
+	return closeErr
+}
+
+func (s *spooled) replay(ctx context.Context, limit int) (int, error) {
+	return s.spool.Replay(limit, func(metrics *data.Metrics) error {
+		return s.backend.SendData(ctx, metrics)
+	})
+}
@@ -0,0 +1,73 @@
+package spool
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeBackend struct {
+	err  error
+	sent []*data.Metrics
+}
+
+func (f *fakeBackend) SendData(_ context.Context, metrics *data.Metrics) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.sent = append(f.sent, metrics)
+	return nil
+}
+
+func TestWrap(t *testing.T) {
+	s, err := New(t.TempDir(), 0, 0)
+	require.Nil(t, err)
+
+	b := &fakeBackend{err: fmt.Errorf("unreachable")}
+	w := s.Wrap(b)
+
+	require.EqualError(t, w.SendData(context.Background(), newMetrics("1")), "unreachable, metrics spooled")
+	require.EqualError(t, w.SendData(context.Background(), newMetrics("2")), "unreachable, metrics spooled")
+	n, err := s.Len()
+	require.Nil(t, err)
+	require.Equal(t, 2, n)
+
+	b.err = nil
+	require.Nil(t, w.SendData(context.Background(), newMetrics("3")))
+	require.Equal(t, 3, len(b.sent))
+	for i, id := range []string{"1", "2", "3"} {
+		require.Equal(t, id, b.sent[i].Container[0].ID)
+	}
+
+	n, err = s.Len()
+	require.Nil(t, err)
+	require.Equal(t, 0, n)
+}
+
+func TestWrapBacklog(t *testing.T) {
+	s, err := New(t.TempDir(), 0, 0)
+	require.Nil(t, err)
+	for i := 0; i < replayBatches+2; i++ {
+		require.Nil(t, s.Push(newMetrics(fmt.Sprint(i))))
+	}
+
+	// Only part of the backlog is sent, the new metrics wait behind the rest
+	b := &fakeBackend{}
+	w := s.Wrap(b)
+	require.Nil(t, w.SendData(context.Background(), newMetrics("new")))
+	require.Equal(t, replayBatches, len(b.sent))
+	n, err := s.Len()
+	require.Nil(t, err)
+	require.Equal(t, 3, n)
+
+	require.Nil(t, w.SendData(context.Background(), newMetrics("newer")))
+	require.Equal(t, replayBatches+4, len(b.sent))
+	require.Equal(t, "new", b.sent[replayBatches+2].Container[0].ID)
+	require.Equal(t, "newer", b.sent[replayBatches+3].Container[0].ID)
+	n, err = s.Len()
+	require.Nil(t, err)
+	require.Equal(t, 0, n)
+}
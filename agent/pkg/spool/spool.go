@@ -0,0 +1,262 @@
+package spool
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+)
+
+const segmentExt = ".json"
+
+type segment struct {
+	path    string
+	created time.Time
+	size    int64
+}
+
+// Spool is a bounded on-disk queue of metrics that could not be sent
+// Every batch is stored in its own segment file named after the time it was
+// spooled, so segments are replayed in the order they were written
+type Spool struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+
+	mu   sync.Mutex
+	last int64
+	now  func() time.Time
+
+	// replayMu is held while replaying, which happens without mu so
+	// sending does not hold up pushing newer metrics
+	replayMu sync.Mutex
+}
+
+func New(dir string, maxBytes int64, maxAge time.Duration) (*Spool, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Spool{
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		now:      time.Now,
+	}, nil
+}
+
+// Push appends the metrics to the spool, dropping the oldest segments if the
+// spool grows past its size or age limits
+func (s *Spool) Push(metrics *data.Metrics) error {
+	bts, err := json.Marshal(metrics)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Segment names must be unique and increasing even if the clock is not
+	id := s.now().UnixNano()
+	if id <= s.last {
+		id = s.last + 1
+	}
+	s.last = id
+
+	name := filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, segmentExt))
+	tmp := name + ".tmp"
+	err = os.WriteFile(tmp, bts, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, name)
+	if err != nil {
+		return err
+	}
+
+	return s.enforceLimits()
+}
+
+// Replay sends at most limit of the spooled batches oldest first, or all of
+// them if limit is zero, removing every segment that was sent successfully.
+// It stops at the first error and returns it, leaving that segment and
+// everything after it in the spool. The number of batches left is returned
+func (s *Spool) Replay(limit int, send func(*data.Metrics) error) (int, error) {
+	s.replayMu.Lock()
+	defer s.replayMu.Unlock()
+
+	s.mu.Lock()
+	err := s.enforceLimits()
+	var segments []segment
+	if err == nil {
+		segments, err = s.segments()
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for i, seg := range segments {
+		if limit > 0 && sent == limit {
+			return len(segments) - i, nil
+		}
+
+		bts, err := os.ReadFile(seg.path)
+		if os.IsNotExist(err) {
+			// Dropped by a push that hit the limits meanwhile
+			continue
+		}
+		if err != nil {
+			return len(segments) - i, err
+		}
+
+		var metrics data.Metrics
+		err = json.Unmarshal(bts, &metrics)
+		if err != nil {
+			// A corrupt segment can never be sent, drop it
+			os.Remove(seg.path)
+			continue
+		}
+		stamp(&metrics, seg.created)
+
+		err = send(&metrics)
+		if err != nil {
+			return len(segments) - i, err
+		}
+
+		err = os.Remove(seg.path)
+		if err != nil && !os.IsNotExist(err) {
+			return len(segments) - i, err
+		}
+		sent++
+	}
+
+	return 0, nil
+}
+
+// stamp sets the timestamps the metrics are missing to t
+// Older versions of the agent spooled metrics without timestamps, the time
+// they were spooled is the closest to when they were collected
+func stamp(metrics *data.Metrics, t time.Time) {
+	if metrics.Host != nil && metrics.Host.Timestamp.IsZero() {
+		metrics.Host.Timestamp = t
+	}
+	for _, c := range metrics.Container {
+		if c.Timestamp.IsZero() {
+			c.Timestamp = t
+		}
+	}
+}
+
+// Len returns the number of batches in the spool
+func (s *Spool) Len() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	segments, err := s.segments()
+	return len(segments), err
+}
+
+// enforceLimits removes segments that are too old and then the oldest
+// segments until the spool fits in its size limit
+func (s *Spool) enforceLimits() error {
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, seg := range segments {
+		total += seg.size
+	}
+
+	now := s.now()
+	for _, seg := range segments {
+		expired := s.maxAge > 0 && now.Sub(seg.created) > s.maxAge
+		tooBig := s.maxBytes > 0 && total > s.maxBytes
+		if !expired && !tooBig {
+			break
+		}
+
+		err = os.Remove(seg.path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= seg.size
+	}
+
+	return nil
+}
+
+// Adopt moves the segments found directly in dir into the spool, e.g. those
+// left behind by a spool that was moved. They keep their names so they are
+// replayed in the order they were written
+func (s *Spool) Adopt(dir string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	segments, err := readSegments(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	for i, seg := range segments {
+		err = os.Rename(seg.path, filepath.Join(s.dir, filepath.Base(seg.path)))
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(segments), nil
+}
+
+// segments returns the segments in the spool, oldest first
+func (s *Spool) segments() ([]segment, error) {
+	return readSegments(s.dir)
+}
+
+// readSegments returns the segments in dir, oldest first
+func readSegments(dir string) ([]segment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []segment
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, segment{
+			path:    filepath.Join(dir, name),
+			created: time.Unix(0, id),
+			size:    info.Size(),
+		})
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].created.Before(ret[j].created)
+	})
+	return ret, nil
+}
@@ -0,0 +1,211 @@
+package spool
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dockwizard/dockwizard_agent/agent/pkg/data"
+	"github.com/stretchr/testify/require"
+)
+
+func newMetrics(id string) *data.Metrics {
+	return &data.Metrics{
+		Container: []*data.ContainerMetrics{{ID: id}},
+	}
+}
+
+func TestPushReplay(t *testing.T) {
+	s, err := New(t.TempDir(), 0, 0)
+	require.Nil(t, err)
+
+	require.Nil(t, s.Push(newMetrics("1")))
+	require.Nil(t, s.Push(newMetrics("2")))
+	require.Nil(t, s.Push(newMetrics("3")))
+
+	n, err := s.Len()
+	require.Nil(t, err)
+	require.Equal(t, 3, n)
+
+	var sent []string
+	_, err = s.Replay(0, func(m *data.Metrics) error {
+		sent = append(sent, m.Container[0].ID)
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, []string{"1", "2", "3"}, sent)
+
+	n, err = s.Len()
+	require.Nil(t, err)
+	require.Equal(t, 0, n)
+}
+
+func TestReplayStopsOnError(t *testing.T) {
+	s, err := New(t.TempDir(), 0, 0)
+	require.Nil(t, err)
+
+	require.Nil(t, s.Push(newMetrics("1")))
+	require.Nil(t, s.Push(newMetrics("2")))
+
+	var sent []string
+	left, err := s.Replay(0, func(m *data.Metrics) error {
+		if m.Container[0].ID == "2" {
+			return fmt.Errorf("unreachable")
+		}
+		sent = append(sent, m.Container[0].ID)
+		return nil
+	})
+	require.EqualError(t, err, "unreachable")
+	require.Equal(t, []string{"1"}, sent)
+	require.Equal(t, 1, left)
+
+	n, err := s.Len()
+	require.Nil(t, err)
+	require.Equal(t, 1, n)
+}
+
+func TestReplayLimit(t *testing.T) {
+	s, err := New(t.TempDir(), 0, 0)
+	require.Nil(t, err)
+
+	require.Nil(t, s.Push(newMetrics("1")))
+	require.Nil(t, s.Push(newMetrics("2")))
+	require.Nil(t, s.Push(newMetrics("3")))
+
+	var sent []string
+	send := func(m *data.Metrics) error {
+		sent = append(sent, m.Container[0].ID)
+		return nil
+	}
+	left, err := s.Replay(2, send)
+	require.Nil(t, err)
+	require.Equal(t, 1, left)
+	require.Equal(t, []string{"1", "2"}, sent)
+
+	left, err = s.Replay(2, send)
+	require.Nil(t, err)
+	require.Equal(t, 0, left)
+	require.Equal(t, []string{"1", "2", "3"}, sent)
+}
+
+func TestReplayStampsOldBatches(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New(dir, 0, 0)
+	require.Nil(t, err)
+
+	// Spooled by a version that did not record when metrics were collected
+	spooled := time.Unix(1700000000, 0)
+	name := filepath.Join(dir, fmt.Sprintf("%020d.json", spooled.UnixNano()))
+	require.Nil(t, os.WriteFile(name, []byte(`{"Host":{"hostname":"docker-1"},"Container":[{"id":"1"}]}`), 0600))
+
+	var sent []*data.Metrics
+	_, err = s.Replay(0, func(m *data.Metrics) error {
+		sent = append(sent, m)
+		return nil
+	})
+	require.Nil(t, err)
+	require.Len(t, sent, 1)
+	require.True(t, spooled.Equal(sent[0].Host.Timestamp))
+	require.True(t, spooled.Equal(sent[0].Container[0].Timestamp))
+}
+
+func TestMaxBytes(t *testing.T) {
+	s, err := New(t.TempDir(), 0, 0)
+	require.Nil(t, err)
+	require.Nil(t, s.Push(newMetrics("1")))
+
+	segments, err := s.segments()
+	require.Nil(t, err)
+	s.maxBytes = segments[0].size * 2
+
+	require.Nil(t, s.Push(newMetrics("2")))
+	require.Nil(t, s.Push(newMetrics("3")))
+
+	var sent []string
+	_, err = s.Replay(0, func(m *data.Metrics) error {
+		sent = append(sent, m.Container[0].ID)
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, []string{"2", "3"}, sent)
+}
+
+func TestMaxAge(t *testing.T) {
+	s, err := New(t.TempDir(), 0, time.Hour)
+	require.Nil(t, err)
+
+	now := time.Now()
+	s.now = func() time.Time { return now.Add(-2 * time.Hour) }
+	require.Nil(t, s.Push(newMetrics("1")))
+	s.now = func() time.Time { return now }
+	require.Nil(t, s.Push(newMetrics("2")))
+
+	var sent []string
+	_, err = s.Replay(0, func(m *data.Metrics) error {
+		sent = append(sent, m.Container[0].ID)
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, []string{"2"}, sent)
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New(dir, 0, 0)
+	require.Nil(t, err)
+	require.Nil(t, s.Push(newMetrics("1")))
+
+	// Leftover temporary and corrupt files are ignored
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "1.json.tmp"), []byte("{"), 0600))
+	require.Nil(t, os.WriteFile(filepath.Join(dir, "00000000000000000002.json"), []byte("{"), 0600))
+
+	s, err = New(dir, 0, 0)
+	require.Nil(t, err)
+
+	var sent []string
+	_, err = s.Replay(0, func(m *data.Metrics) error {
+		sent = append(sent, m.Container[0].ID)
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, []string{"1"}, sent)
+}
+
+func TestAdopt(t *testing.T) {
+	dir := t.TempDir()
+	old, err := New(dir, 0, 0)
+	require.Nil(t, err)
+	require.Nil(t, old.Push(newMetrics("1")))
+	require.Nil(t, old.Push(newMetrics("2")))
+
+	s, err := New(filepath.Join(dir, "api"), 0, 0)
+	require.Nil(t, err)
+	require.Nil(t, s.Push(newMetrics("3")))
+
+	n, err := s.Adopt(dir)
+	require.Nil(t, err)
+	require.Equal(t, 2, n)
+
+	n, err = old.Len()
+	require.Nil(t, err)
+	require.Equal(t, 0, n)
+
+	var sent []string
+	_, err = s.Replay(0, func(m *data.Metrics) error {
+		sent = append(sent, m.Container[0].ID)
+		return nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, []string{"1", "2", "3"}, sent)
+}
+
+func TestAdoptMissing(t *testing.T) {
+	s, err := New(t.TempDir(), 0, 0)
+	require.Nil(t, err)
+
+	n, err := s.Adopt(filepath.Join(t.TempDir(), "missing"))
+	require.Nil(t, err)
+	require.Equal(t, 0, n)
+}